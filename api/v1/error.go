@@ -25,3 +25,105 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrLogReadOnly struct {
+	Dir string
+}
+
+func (e ErrLogReadOnly) GRPCStatus() *status.Status {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("log is read-only: %s", e.Dir))
+	msg := fmt.Sprintf("The log ran out of disk space and is only serving reads: %s", e.Dir)
+	d := &errdetails.LocalizedMessage{Locale: "en-US", Message: msg}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrLogReadOnly) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrReplicationTimeout struct {
+	Offset   uint64
+	Acked    int
+	Required int
+}
+
+func (e ErrReplicationTimeout) GRPCStatus() *status.Status {
+	st := status.New(codes.DeadlineExceeded, fmt.Sprintf("replication timed out: %d", e.Offset))
+	msg := fmt.Sprintf("The record was appended at offset %d but only %d of the %d required replicas copied it in time",
+		e.Offset, e.Acked, e.Required)
+	d := &errdetails.LocalizedMessage{Locale: "en-US", Message: msg}
+	info := &errdetails.ErrorInfo{Reason: "REPLICATION_TIMEOUT", Domain: "log"}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrReplicationTimeout) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNotEnoughReplicas struct {
+	InSync   int
+	Required int
+}
+
+func (e ErrNotEnoughReplicas) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, fmt.Sprintf("not enough in-sync replicas: %d", e.InSync))
+	msg := fmt.Sprintf("The record wasn't appended, %d replicas are in sync while %d are required",
+		e.InSync, e.Required)
+	d := &errdetails.LocalizedMessage{Locale: "en-US", Message: msg}
+	info := &errdetails.ErrorInfo{Reason: "NOT_ENOUGH_REPLICAS", Domain: "log"}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotEnoughReplicas) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNotLeader struct {
+	LeaderAddr string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("not the leader, the leader is %s", e.LeaderAddr))
+	msg := fmt.Sprintf("The server only appends records through the leader, send the request to %s", e.LeaderAddr)
+	d := &errdetails.LocalizedMessage{Locale: "en-US", Message: msg}
+	info := &errdetails.ErrorInfo{Reason: "NOT_LEADER", Domain: "log", Metadata: map[string]string{"leader_addr": e.LeaderAddr}}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrObserver struct{}
+
+func (e ErrObserver) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, "server is a read-only observer")
+	msg := "The server is an observer replica that only serves reads, send the request to another server"
+	d := &errdetails.LocalizedMessage{Locale: "en-US", Message: msg}
+	info := &errdetails.ErrorInfo{Reason: "OBSERVER", Domain: "log"}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrObserver) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -22,6 +22,15 @@ type LogClient interface {
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error)
 	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (Log_ProduceStreamClient, error)
 	ProduceBulkRecords(ctx context.Context, opts ...grpc.CallOption) (Log_ProduceBulkRecordsClient, error)
+	GetReplicationStatus(ctx context.Context, in *GetReplicationStatusRequest, opts ...grpc.CallOption) (*GetReplicationStatusResponse, error)
+	AcknowledgeReplication(ctx context.Context, in *AcknowledgeReplicationRequest, opts ...grpc.CallOption) (*AcknowledgeReplicationResponse, error)
+	GetInSyncReplicas(ctx context.Context, in *GetInSyncReplicasRequest, opts ...grpc.CallOption) (*GetInSyncReplicasResponse, error)
+	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchResponse, error)
+	FetchSegments(ctx context.Context, in *FetchSegmentsRequest, opts ...grpc.CallOption) (Log_FetchSegmentsClient, error)
+	GetDigests(ctx context.Context, in *GetDigestsRequest, opts ...grpc.CallOption) (*GetDigestsResponse, error)
+	ReadOriginRange(ctx context.Context, in *ReadOriginRangeRequest, opts ...grpc.CallOption) (*ReadOriginRangeResponse, error)
+	SetReplicationThrottle(ctx context.Context, in *SetReplicationThrottleRequest, opts ...grpc.CallOption) (*SetReplicationThrottleResponse, error)
+	GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error)
 }
 
 type logClient struct {
@@ -147,6 +156,110 @@ func (x *logProduceBulkRecordsClient) CloseAndRecv() (*ProduceBulkResponse, erro
 	return m, nil
 }
 
+func (c *logClient) GetReplicationStatus(ctx context.Context, in *GetReplicationStatusRequest, opts ...grpc.CallOption) (*GetReplicationStatusResponse, error) {
+	out := new(GetReplicationStatusResponse)
+	err := c.cc.Invoke(ctx, "/Log/GetReplicationStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) AcknowledgeReplication(ctx context.Context, in *AcknowledgeReplicationRequest, opts ...grpc.CallOption) (*AcknowledgeReplicationResponse, error) {
+	out := new(AcknowledgeReplicationResponse)
+	err := c.cc.Invoke(ctx, "/Log/AcknowledgeReplication", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) GetInSyncReplicas(ctx context.Context, in *GetInSyncReplicasRequest, opts ...grpc.CallOption) (*GetInSyncReplicasResponse, error) {
+	out := new(GetInSyncReplicasResponse)
+	err := c.cc.Invoke(ctx, "/Log/GetInSyncReplicas", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchResponse, error) {
+	out := new(FetchResponse)
+	err := c.cc.Invoke(ctx, "/Log/Fetch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) FetchSegments(ctx context.Context, in *FetchSegmentsRequest, opts ...grpc.CallOption) (Log_FetchSegmentsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Log_serviceDesc.Streams[3], "/Log/FetchSegments", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logFetchSegmentsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_FetchSegmentsClient interface {
+	Recv() (*SegmentChunk, error)
+	grpc.ClientStream
+}
+
+type logFetchSegmentsClient struct {
+	grpc.ClientStream
+}
+
+func (x *logFetchSegmentsClient) Recv() (*SegmentChunk, error) {
+	m := new(SegmentChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logClient) GetDigests(ctx context.Context, in *GetDigestsRequest, opts ...grpc.CallOption) (*GetDigestsResponse, error) {
+	out := new(GetDigestsResponse)
+	err := c.cc.Invoke(ctx, "/Log/GetDigests", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) ReadOriginRange(ctx context.Context, in *ReadOriginRangeRequest, opts ...grpc.CallOption) (*ReadOriginRangeResponse, error) {
+	out := new(ReadOriginRangeResponse)
+	err := c.cc.Invoke(ctx, "/Log/ReadOriginRange", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) SetReplicationThrottle(ctx context.Context, in *SetReplicationThrottleRequest, opts ...grpc.CallOption) (*SetReplicationThrottleResponse, error) {
+	out := new(SetReplicationThrottleResponse)
+	err := c.cc.Invoke(ctx, "/Log/SetReplicationThrottle", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error) {
+	out := new(GetServersResponse)
+	err := c.cc.Invoke(ctx, "/Log/GetServers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LogServer is the server API for Log service.
 // All implementations must embed UnimplementedLogServer
 // for forward compatibility
@@ -156,6 +269,15 @@ type LogServer interface {
 	ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error
 	ProduceStream(Log_ProduceStreamServer) error
 	ProduceBulkRecords(Log_ProduceBulkRecordsServer) error
+	GetReplicationStatus(context.Context, *GetReplicationStatusRequest) (*GetReplicationStatusResponse, error)
+	AcknowledgeReplication(context.Context, *AcknowledgeReplicationRequest) (*AcknowledgeReplicationResponse, error)
+	GetInSyncReplicas(context.Context, *GetInSyncReplicasRequest) (*GetInSyncReplicasResponse, error)
+	Fetch(context.Context, *FetchRequest) (*FetchResponse, error)
+	FetchSegments(*FetchSegmentsRequest, Log_FetchSegmentsServer) error
+	GetDigests(context.Context, *GetDigestsRequest) (*GetDigestsResponse, error)
+	ReadOriginRange(context.Context, *ReadOriginRangeRequest) (*ReadOriginRangeResponse, error)
+	SetReplicationThrottle(context.Context, *SetReplicationThrottleRequest) (*SetReplicationThrottleResponse, error)
+	GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error)
 	mustEmbedUnimplementedLogServer()
 }
 
@@ -178,6 +300,33 @@ func (UnimplementedLogServer) ProduceStream(Log_ProduceStreamServer) error {
 func (UnimplementedLogServer) ProduceBulkRecords(Log_ProduceBulkRecordsServer) error {
 	return status.Errorf(codes.Unimplemented, "method ProduceBulkRecords not implemented")
 }
+func (UnimplementedLogServer) GetReplicationStatus(context.Context, *GetReplicationStatusRequest) (*GetReplicationStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReplicationStatus not implemented")
+}
+func (UnimplementedLogServer) AcknowledgeReplication(context.Context, *AcknowledgeReplicationRequest) (*AcknowledgeReplicationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AcknowledgeReplication not implemented")
+}
+func (UnimplementedLogServer) GetInSyncReplicas(context.Context, *GetInSyncReplicasRequest) (*GetInSyncReplicasResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetInSyncReplicas not implemented")
+}
+func (UnimplementedLogServer) Fetch(context.Context, *FetchRequest) (*FetchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Fetch not implemented")
+}
+func (UnimplementedLogServer) FetchSegments(*FetchSegmentsRequest, Log_FetchSegmentsServer) error {
+	return status.Errorf(codes.Unimplemented, "method FetchSegments not implemented")
+}
+func (UnimplementedLogServer) GetDigests(context.Context, *GetDigestsRequest) (*GetDigestsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDigests not implemented")
+}
+func (UnimplementedLogServer) ReadOriginRange(context.Context, *ReadOriginRangeRequest) (*ReadOriginRangeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReadOriginRange not implemented")
+}
+func (UnimplementedLogServer) SetReplicationThrottle(context.Context, *SetReplicationThrottleRequest) (*SetReplicationThrottleResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetReplicationThrottle not implemented")
+}
+func (UnimplementedLogServer) GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
+}
 func (UnimplementedLogServer) mustEmbedUnimplementedLogServer() {}
 
 // UnsafeLogServer may be embedded to opt out of forward compatibility for this service.
@@ -300,6 +449,171 @@ func (x *logProduceBulkRecordsServer) Recv() (*ProduceRequest, error) {
 	return m, nil
 }
 
+func _Log_GetReplicationStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReplicationStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetReplicationStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Log/GetReplicationStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetReplicationStatus(ctx, req.(*GetReplicationStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_AcknowledgeReplication_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AcknowledgeReplicationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).AcknowledgeReplication(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Log/AcknowledgeReplication",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).AcknowledgeReplication(ctx, req.(*AcknowledgeReplicationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_GetInSyncReplicas_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetInSyncReplicasRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetInSyncReplicas(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Log/GetInSyncReplicas",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetInSyncReplicas(ctx, req.(*GetInSyncReplicasRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_Fetch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).Fetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Log/Fetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).Fetch(ctx, req.(*FetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_FetchSegments_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FetchSegmentsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).FetchSegments(m, &logFetchSegmentsServer{stream})
+}
+
+type Log_FetchSegmentsServer interface {
+	Send(*SegmentChunk) error
+	grpc.ServerStream
+}
+
+type logFetchSegmentsServer struct {
+	grpc.ServerStream
+}
+
+func (x *logFetchSegmentsServer) Send(m *SegmentChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Log_GetDigests_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDigestsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetDigests(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Log/GetDigests",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetDigests(ctx, req.(*GetDigestsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_ReadOriginRange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadOriginRangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).ReadOriginRange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Log/ReadOriginRange",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).ReadOriginRange(ctx, req.(*ReadOriginRangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_SetReplicationThrottle_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetReplicationThrottleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).SetReplicationThrottle(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Log/SetReplicationThrottle",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).SetReplicationThrottle(ctx, req.(*SetReplicationThrottleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_GetServers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetServers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Log/GetServers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetServers(ctx, req.(*GetServersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Log_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "Log",
 	HandlerType: (*LogServer)(nil),
@@ -312,6 +626,38 @@ var _Log_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Consume",
 			Handler:    _Log_Consume_Handler,
 		},
+		{
+			MethodName: "GetReplicationStatus",
+			Handler:    _Log_GetReplicationStatus_Handler,
+		},
+		{
+			MethodName: "AcknowledgeReplication",
+			Handler:    _Log_AcknowledgeReplication_Handler,
+		},
+		{
+			MethodName: "GetInSyncReplicas",
+			Handler:    _Log_GetInSyncReplicas_Handler,
+		},
+		{
+			MethodName: "Fetch",
+			Handler:    _Log_Fetch_Handler,
+		},
+		{
+			MethodName: "GetDigests",
+			Handler:    _Log_GetDigests_Handler,
+		},
+		{
+			MethodName: "ReadOriginRange",
+			Handler:    _Log_ReadOriginRange_Handler,
+		},
+		{
+			MethodName: "SetReplicationThrottle",
+			Handler:    _Log_SetReplicationThrottle_Handler,
+		},
+		{
+			MethodName: "GetServers",
+			Handler:    _Log_GetServers_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -330,6 +676,11 @@ var _Log_serviceDesc = grpc.ServiceDesc{
 			Handler:       _Log_ProduceBulkRecords_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "FetchSegments",
+			Handler:       _Log_FetchSegments_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api/v1/log.proto",
 }
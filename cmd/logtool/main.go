@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/pandulaDW/go-distributed-service/internal/log"
+	"google.golang.org/protobuf/encoding/protojson"
+	"os"
+)
+
+const usage = `usage: logtool <command> [flags] <log dir>
+
+commands:
+  fsck      check a log for inconsistencies without modifying it
+              -dump    print the records of the log as JSON instead
+              -repair  fix the inconsistencies found, the log must not be in use
+  migrate   rewrite a log to the latest on-disk format, the log must not be in use
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "fsck":
+		err = fsck(os.Args[2:])
+	case "migrate":
+		err = migrate(os.Args[2:])
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+}
+
+// migrate implements the migrate command
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	maxStoreBytes := flags.Uint64("max-store-bytes", 0, "max store bytes of the migrated segments, 0 keeps the original size")
+	maxIndexBytes := flags.Uint64("max-index-bytes", 0, "max index bytes of the migrated segments, 0 keeps the original size")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a single log directory")
+	}
+	dir := flags.Arg(0)
+
+	from, err := log.FormatVersion(dir)
+	if err != nil {
+		return err
+	}
+	if from == log.LatestFormat {
+		fmt.Printf("%s is already in the latest format (v%d)\n", dir, from)
+		return nil
+	}
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = *maxStoreBytes
+	c.Segment.MaxIndexBytes = *maxIndexBytes
+	if err = log.Migrate(dir, c); err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %s from format v%d to v%d\n", dir, from, log.LatestFormat)
+	return nil
+}
+
+// fsck implements the fsck command
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dump := flags.Bool("dump", false, "print the records of the log as JSON")
+	repair := flags.Bool("repair", false, "fix the inconsistencies found")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a single log directory")
+	}
+	dir := flags.Arg(0)
+
+	if *dump {
+		return log.WalkRecords(dir, func(record *api.Record) error {
+			b, err := protojson.Marshal(record)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return nil
+		})
+	}
+
+	check := log.Check
+	if *repair {
+		check = log.Repair
+	}
+	report, err := check(dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("log %s, format v%d\n", report.Dir, report.Format)
+	for _, s := range report.Segments {
+		records := s.NextOffset - s.BaseOffset
+		fmt.Printf("segment %d: %d records", s.BaseOffset, records)
+		if records > 0 {
+			fmt.Printf(" (offsets %d-%d)", s.BaseOffset, s.NextOffset-1)
+		}
+		fmt.Printf(", store %d bytes, index %d bytes\n", s.StoreBytes, s.IndexBytes)
+	}
+
+	unrepaired := 0
+	for _, issue := range report.Issues {
+		status := "repaired"
+		if !issue.Repaired {
+			status = "not repaired"
+			unrepaired++
+		}
+		if !*repair {
+			status = "issue"
+		}
+		fmt.Printf("%s: %s: %s\n", status, issue.File, issue.Problem)
+	}
+
+	if unrepaired > 0 {
+		return fmt.Errorf("found %d inconsistencies", unrepaired)
+	}
+	return nil
+}
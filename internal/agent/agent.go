@@ -1,31 +1,132 @@
 package agent
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
 	api "github.com/pandulaDW/go-distributed-service/api/v1"
 	"github.com/pandulaDW/go-distributed-service/internal/auth"
 	"github.com/pandulaDW/go-distributed-service/internal/discovery"
 	"github.com/pandulaDW/go-distributed-service/internal/log"
+	"github.com/pandulaDW/go-distributed-service/internal/mirror"
 	"github.com/pandulaDW/go-distributed-service/internal/server"
+	"github.com/soheilhy/cmux"
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"io"
 	"net"
+	"sort"
 	"sync"
+	"time"
+)
+
+// ReplicationMode selects how the agents replicate their log
+type ReplicationMode string
+
+const (
+	// PullReplication has every agent consume the records of the others with a Replicator.
+	// It's the default mode.
+	PullReplication ReplicationMode = "pull"
+	// RaftReplication replicates the log with Raft, appending through the elected leader
+	RaftReplication ReplicationMode = "raft"
+)
+
+// Role is the part the agent plays in the cluster
+type Role string
+
+const (
+	// VoterRole agents accept produce requests and count toward the replicas acknowledging
+	// records, or the Raft quorum. It's the default role.
+	VoterRole Role = "voter"
+	// ObserverRole agents replicate every log and serve the reads, but refuse produce requests,
+	// never count toward the replicas acknowledging records and never become the Raft leader
+	ObserverRole Role = discovery.ObserverRole
 )
 
 // Config for Agent
 type Config struct {
 	ServerTLSConfig *tls.Config
 	PeerTLSConfig   *tls.Config
-	DataDir         string
+	DataDirs        []string
 	BindAddr        string
 	RPCPort         int
 	NodeName        string
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLPolicyFile   string
+	// ReplicationMode defaults to PullReplication
+	ReplicationMode ReplicationMode
+	// Role defaults to VoterRole
+	Role Role
+	// AckReplicas is the number of other agents that must copy a record before a produce
+	// request with ACKS_ALL is acknowledged, 1 by default. Agents replicating with Raft
+	// acknowledge records once a quorum of them stored the record instead.
+	AckReplicas int
+	// MinInSyncReplicas is the number of other agents that must be in sync, having caught up
+	// with the log within InSyncLagWindow, for produce requests with ACKS_ALL to be accepted
+	MinInSyncReplicas int
+	InSyncLagWindow   time.Duration
+	// Rack and Zone locate the agent, which it advertises to the other agents so that the
+	// replicas of the logs spread across zones
+	Rack string
+	Zone string
+	// ReplicationFactor is the number of other agents that copy the records produced to each
+	// agent replicating with PullReplication, placed across as many zones as possible. Every
+	// agent copies the records of every other agent while it's 0.
+	ReplicationFactor int
+	// VerifyInterval has the agents replicating with PullReplication verify their log against
+	// the other agents' logs at that interval, reporting the ranges holding different records
+	// in their replication status. Verification is disabled while it's 0. RepairFrom is the
+	// agent the divergent ranges are repaired from, if any.
+	VerifyInterval time.Duration
+	RepairFrom     string
+	// ReplicationRateLimit and PeerReplicationRateLimit limit the bytes per second the agents
+	// replicating with PullReplication copy in total and from each other agent, so that an
+	// agent catching up doesn't saturate the network. They're unlimited while 0, and replaced
+	// at runtime with the SetReplicationThrottle admin RPC.
+	ReplicationRateLimit     uint64
+	PeerReplicationRateLimit uint64
+	// RedirectWrites has the followers of the agents replicating with Raft refuse produce
+	// requests with the leader's address, instead of forwarding them to the leader
+	RedirectWrites bool
+	// Bootstrap has the agent bootstrap a new Raft cluster. Only the first agent of a
+	// cluster replicating with Raft sets it, the others join the cluster it started.
+	Bootstrap bool
+	// MirrorAddr has the agent mirror the records of a remote cluster, such as the cluster of
+	// another region, from the server at that address into its own cluster, connecting with
+	// MirrorTLSConfig. Only the records whose value starts with one of MirrorPrefixes are
+	// mirrored, or every record when there are none. A single agent of the cluster sets it,
+	// which can't be an observer since the records are produced to the agent itself.
+	//
+	// Cluster names the agent's cluster and MirrorCluster the remote one, which both need to be
+	// set to mirror. The records first produced to the agent's cluster aren't mirrored back, so
+	// two clusters can mirror each other.
+	MirrorAddr      string
+	MirrorTLSConfig *tls.Config
+	MirrorPrefixes  [][]byte
+	Cluster         string
+	MirrorCluster   string
+}
+
+// validate checks the settings that can't go together, before the agent sets anything up
+func (c Config) validate() error {
+	if c.Role == ObserverRole && c.Bootstrap && c.ReplicationMode == RaftReplication {
+		return fmt.Errorf("an observer can't bootstrap the Raft cluster")
+	}
+	if c.MirrorAddr == "" {
+		return nil
+	}
+	if c.Role == ObserverRole {
+		return fmt.Errorf("an observer can't mirror a remote cluster")
+	}
+	if c.Cluster == "" || c.MirrorCluster == "" {
+		return fmt.Errorf("mirroring a remote cluster needs the names of both clusters")
+	}
+	return nil
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -40,18 +141,29 @@ func (c Config) RPCAddr() (string, error) {
 // The struct references each component (log, server, membership, replicator) that the Agent manages.
 type Agent struct {
 	Config
-	log          *log.Log
-	server       *grpc.Server
-	membership   *discovery.Membership
-	replicator   *log.Replicator
-	shutdown     bool
-	shutdowns    chan struct{}
-	shutdownLock sync.Mutex
+	ln             net.Listener
+	mux            cmux.CMux
+	dataDirs       *log.DataDirs
+	log            *log.Log
+	distributedLog *log.DistributedLog
+	server         *server.Server
+	membership     *discovery.Membership
+	replicator     *log.Replicator
+	mirror         *mirror.Mirror
+	placementLock  sync.Mutex
+	placement      map[string]bool
+	shutdown       bool
+	shutdowns      chan struct{}
+	shutdownLock   sync.Mutex
 }
 
 // New creates an Agent and runs a set of methods to set up
-// and run the agent’s components.
+// and run the agent’s components. The components already set up are shut down when one
+// fails to.
 func New(config Config) (*Agent, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 	a := &Agent{
 		Config:    config,
 		shutdowns: make(chan struct{}),
@@ -59,20 +171,30 @@ func New(config Config) (*Agent, error) {
 
 	setup := []func() error{
 		a.setupLogger,
-		a.setupLogger,
+		a.setupMux,
+		a.setupLog,
+		a.setupReplicator,
 		a.setupServer,
+		a.setupMembership,
+		a.setupMirror,
 	}
 
 	for _, fn := range setup {
 		if err := fn(); err != nil {
+			// the listeners matched by the mux only close once it's serving
+			if a.mux != nil {
+				go a.serve()
+			}
+			_ = a.Shutdown()
 			return nil, err
 		}
 	}
+	go a.serve()
 
 	return a, nil
 }
 
-// Shutdown shut down the agent and all its components
+// Shutdown shut down the agent and all its components, the ones that were set up at least
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
@@ -85,13 +207,47 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
-		a.membership.Leave,
-		a.replicator.Close,
 		func() error {
-			a.server.GracefulStop()
+			if a.mirror != nil {
+				return a.mirror.Close()
+			}
+			return nil
+		},
+		func() error {
+			if a.membership != nil {
+				return a.membership.Leave()
+			}
+			return nil
+		},
+		func() error {
+			if a.replicator != nil {
+				return a.replicator.Close()
+			}
+			return nil
+		},
+		func() error {
+			if a.server != nil {
+				a.server.GracefulStop()
+			}
+			return nil
+		},
+		func() error {
+			if a.distributedLog != nil {
+				return a.distributedLog.Close()
+			}
+			if a.log != nil {
+				return a.log.Close()
+			}
+			return nil
+		},
+		func() error {
+			// the server and Raft close the listener along with the ones the mux matched for
+			// them, so it's only left open when they weren't set up
+			if a.ln != nil {
+				_ = a.ln.Close()
+			}
 			return nil
 		},
-		a.log.Close,
 	}
 
 	for _, fn := range shutdown {
@@ -113,19 +269,127 @@ func (a *Agent) setupLogger() error {
 	return nil
 }
 
-// setupLog sets up the service Logger with default configs
+// setupMux listens on the RPC address, which the agent's gRPC server shares with Raft
+// in RaftReplication mode, and multiplexes the connections between them.
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return err
+	}
+	a.ln, err = net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	a.mux = cmux.New(a.ln)
+	return nil
+}
+
+// logName is the name of the agent's log inside its data directories, and
+// distributedLogName the name of the log replicated with Raft
+const (
+	logName            = "log"
+	distributedLogName = "distributed-log"
+)
+
+// setupLog sets up the service Logger with default configs, placing it in the data
+// directory that already holds it or the one with the most free space
 func (a *Agent) setupLog() error {
 	var err error
-	a.log, err = log.NewLog(a.Config.DataDir, log.Config{})
+	a.dataDirs, err = log.NewDataDirs(a.Config.DataDirs)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range a.dataDirs.Usage() {
+		if u.Err != nil {
+			zap.L().Error("data directory failed", zap.String("dir", u.Dir), zap.Error(u.Err))
+		}
+	}
+
+	if a.Config.ReplicationMode == RaftReplication {
+		return a.setupDistributedLog()
+	}
+	// the records produced to the agent carry its name, so that its segments can be shipped
+	// to the agents bootstrapping from it
+	logConfig := log.Config{}
+	logConfig.Origin = a.Config.NodeName
+	logConfig.Disk.OnFailure = a.diskFailed
+	a.log, err = a.dataDirs.Open(logName, logConfig)
 	return err
 }
 
+// diskFailed logs the disk failure of the agent's log, whose data directory is failed along
+func (a *Agent) diskFailed(err error) {
+	zap.L().Error("data directory of the log failed", zap.Error(err))
+}
+
+// setupDistributedLog sets up the log replicated with Raft, which receives the connections
+// starting with the RaftRPC byte.
+func (a *Agent) setupDistributedLog() error {
+	raftLn := a.mux.Match(func(reader io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := reader.Read(b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
+	})
+
+	dir, err := a.dataDirs.Path(distributedLogName)
+	if err != nil {
+		return err
+	}
+
+	logConfig := log.Config{}
+	logConfig.Disk.OnFailure = a.diskFailed
+	logConfig = a.dataDirs.Watch(dir, logConfig)
+	logConfig.Raft.StreamLayer = log.NewStreamLayer(raftLn, a.Config.ServerTLSConfig, a.Config.PeerTLSConfig)
+	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
+	logConfig.Raft.Bootstrap = a.Config.Bootstrap
+	a.distributedLog, err = log.NewDistributedLog(dir, logConfig)
+	if err != nil {
+		return err
+	}
+
+	if a.Config.Bootstrap {
+		return a.distributedLog.WaitForLeader(3 * time.Second)
+	}
+	return nil
+}
+
+// DataDirUsage reports the disk usage of each of the agent's data directories
+func (a *Agent) DataDirUsage() []log.DirUsage {
+	return a.dataDirs.Usage()
+}
+
+// RecoverDataDir brings a failed data directory of the agent back into use, once its disk was
+// fixed or replaced
+func (a *Agent) RecoverDataDir(dir string) error {
+	return a.dataDirs.Recover(dir)
+}
+
 // setupServer sets up the grpc server and runs it in a go-routine
 func (a *Agent) setupServer() error {
 	authorizer := auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
 	serverConfig := &server.Config{
 		CommitLog:  a.log,
 		Authorizer: authorizer,
+		Observer:   a.Config.Role == ObserverRole,
+		// the membership is set up after the server, and only listed once requests come in
+		ServerGetter: a,
+	}
+	if a.distributedLog != nil {
+		serverConfig.CommitLog = a.distributedLog
+		serverConfig.ForwardDialOptions = a.peerDialOptions()
+		serverConfig.RedirectWrites = a.Config.RedirectWrites
+	}
+	if a.replicator != nil {
+		serverConfig.Replication = a.replicator
+		serverConfig.AckReplicas = a.Config.AckReplicas
+		if serverConfig.AckReplicas == 0 {
+			serverConfig.AckReplicas = 1
+		}
+		serverConfig.MinInSyncReplicas = a.Config.MinInSyncReplicas
+		serverConfig.InSyncLagWindow = a.Config.InSyncLagWindow
 	}
 
 	var opts []grpc.ServerOption
@@ -135,23 +399,15 @@ func (a *Agent) setupServer() error {
 	}
 
 	var err error
-	a.server, err = server.NewGRPCServer(serverConfig)
-	if err != nil {
-		return err
-	}
-
-	rpcAddr, err := a.RPCAddr()
-	if err != nil {
-		return err
-	}
-
-	listener, err := net.Listen("tcp", rpcAddr)
+	a.server, err = server.NewGRPCServer(serverConfig, opts...)
 	if err != nil {
 		return err
 	}
 
+	// every connection that isn't Raft's is a gRPC one
+	grpcLn := a.mux.Match(cmux.Any())
 	go func() {
-		if err = a.server.Serve(listener); err != nil {
+		if err := a.server.Serve(grpcLn); err != nil {
 			_ = a.Shutdown()
 		}
 	}()
@@ -159,41 +415,232 @@ func (a *Agent) setupServer() error {
 	return nil
 }
 
-// setupMembership sets up a Replicator with the gRPC dial options needed to connect
-// to other servers and a client so the replicator can connect to other servers,
-// consume their data, and produce a copy of the data to the local server
-func (a *Agent) setupMembership() error {
-	rpcAddr, err := a.Config.RPCAddr()
+// setupReplicator sets up a Replicator with the gRPC dial options needed to connect
+// to other servers, fetch their data, and append a copy of the data to the local log.
+// Agents replicating with Raft don't need one.
+func (a *Agent) setupReplicator() error {
+	if a.distributedLog != nil {
+		return nil
+	}
+
+	opts := a.peerDialOptions()
+
+	// the checkpoints are kept with the log, so they're lost along with the records
+	checkpoints, err := log.NewCheckpoints(a.log.Dir)
 	if err != nil {
 		return err
 	}
+	if err = checkpoints.Recover(a.log); err != nil {
+		return err
+	}
+
+	if err = view.Register(log.ReplicationViews...); err != nil {
+		return err
+	}
+
+	a.replicator = &log.Replicator{
+		DialOptions:    opts,
+		LocalLog:       a.log,
+		Bootstrap:      a.log,
+		Checkpoints:    checkpoints,
+		NodeName:       a.Config.NodeName,
+		VerifyInterval: a.Config.VerifyInterval,
+		RepairFrom:     a.Config.RepairFrom,
+		Observer:       a.Config.Role == ObserverRole,
+		RateLimit:      a.Config.ReplicationRateLimit,
+		PeerRateLimit:  a.Config.PeerReplicationRateLimit,
+	}
+	// the observers copy every log
+	if a.Config.ReplicationFactor > 0 && !a.replicator.Observer {
+		a.replicator.Assigned = a.assigned
+	}
+	if a.Config.VerifyInterval > 0 {
+		a.replicator.Verify = a.log
+	}
+	return nil
+}
 
+// peerDialOptions returns the gRPC dial options to connect to the other agents with
+func (a *Agent) peerDialOptions() []grpc.DialOption {
 	var opts []grpc.DialOption
 	if a.Config.PeerTLSConfig != nil {
 		opts = append(opts, grpc.WithTransportCredentials(
 			credentials.NewTLS(a.Config.PeerTLSConfig),
 		))
 	}
+	return opts
+}
 
-	conn, err := grpc.Dial(rpcAddr, opts...)
+// setupMembership sets up the discovery of the other servers, which the replicator copies
+// the logs of, or which join the Raft cluster of the agents replicating with Raft
+func (a *Agent) setupMembership() error {
+	rpcAddr, err := a.Config.RPCAddr()
 	if err != nil {
 		return err
 	}
 
-	client := api.NewLogClient(conn)
-	a.replicator = &log.Replicator{
-		DialOptions: opts,
-		LocalServer: client,
+	var handler discovery.Handler = a.replicator
+	if a.distributedLog != nil {
+		handler = a.distributedLog
 	}
 
-	a.membership, err = discovery.New(a.replicator, discovery.Config{
+	role := a.Config.Role
+	if role == "" {
+		role = VoterRole
+	}
+	a.membership, err = discovery.New(handler, discovery.Config{
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
+			"rpc_addr":        rpcAddr,
+			discovery.RackTag: a.Config.Rack,
+			discovery.ZoneTag: a.Config.Zone,
+			discovery.RoleTag: string(role),
 		},
 		StartJoinAddrs: a.Config.StartJoinAddrs,
 	})
+	return err
+}
 
+// mirrorName is the name of the directory holding the mirror's checkpoint and offset
+// translation table inside the agent's data directories
+const mirrorName = "mirror"
+
+// setupMirror starts mirroring the remote cluster at MirrorAddr, if set, producing its records
+// to the agent itself, which forwards them to the leader when replicating with Raft
+func (a *Agent) setupMirror() error {
+	if a.Config.MirrorAddr == "" {
+		return nil
+	}
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return err
+	}
+	dir, err := a.dataDirs.Path(mirrorName)
+	if err != nil {
+		return err
+	}
+	a.mirror, err = mirror.New(mirror.Config{
+		RemoteAddr:      a.Config.MirrorAddr,
+		RemoteTLSConfig: a.Config.MirrorTLSConfig,
+		LocalAddr:       rpcAddr,
+		LocalTLSConfig:  a.Config.PeerTLSConfig,
+		Prefixes:        a.Config.MirrorPrefixes,
+		Cluster:         a.Config.Cluster,
+		RemoteCluster:   a.Config.MirrorCluster,
+		Dir:             dir,
+	})
 	return err
 }
+
+// Mirror returns the mirror of the remote cluster, which translates the offsets of the remote
+// cluster's consumers failing over to the agent's cluster, or nil if the agent doesn't mirror
+func (a *Agent) Mirror() *mirror.Mirror {
+	return a.mirror
+}
+
+// assigned reports whether the agent is one of the replicas of the origin agent's log, placed
+// among the members alive, so that the replicas of the members failing or leaving are replaced.
+// The origins that aren't members of the cluster anymore keep their last placement, and the
+// records of the ones the agent never placed are copied.
+func (a *Agent) assigned(origin string) bool {
+	if a.membership == nil {
+		return true
+	}
+
+	a.placementLock.Lock()
+	defer a.placementLock.Unlock()
+	if a.placement == nil {
+		a.placement = make(map[string]bool)
+	}
+
+	nodes := a.membership.Nodes()
+	for _, owner := range nodes {
+		if owner.Name != origin {
+			continue
+		}
+		assigned := false
+		for _, replica := range discovery.PlaceReplicas(owner, nodes, a.Config.ReplicationFactor) {
+			if replica.Name == a.Config.NodeName {
+				assigned = true
+			}
+		}
+		a.placement[origin] = assigned
+		return assigned
+	}
+	if assigned, ok := a.placement[origin]; ok {
+		return assigned
+	}
+	return true
+}
+
+// PlacementReport reports where the copies of each agent's log live, flagging the logs whose
+// copies all live in one zone
+func (a *Agent) PlacementReport() []discovery.LogPlacement {
+	n := a.Config.ReplicationFactor
+	if a.distributedLog != nil {
+		// every agent replicating with Raft holds the whole log
+		n = 0
+	}
+	return discovery.PlacementReport(a.membership.Nodes(), n)
+}
+
+// GetServers lists the members of the cluster that didn't leave it, with their role, their
+// location and whether they're healthy
+func (a *Agent) GetServers() ([]*api.Server, error) {
+	var leaderAddr string
+	if a.distributedLog != nil {
+		leaderAddr, _ = a.distributedLog.Leader()
+	}
+
+	var servers []*api.Server
+	for _, member := range a.membership.Members() {
+		if member.Status == serf.StatusLeft {
+			continue
+		}
+		srv := &api.Server{
+			Id:      member.Name,
+			RpcAddr: member.Tags["rpc_addr"],
+			Zone:    member.Tags[discovery.ZoneTag],
+			Rack:    member.Tags[discovery.RackTag],
+			Healthy: member.Status == serf.StatusAlive,
+		}
+		switch {
+		case member.Tags[discovery.RoleTag] == discovery.ObserverRole:
+			srv.Role = api.ServerRole_ROLE_OBSERVER
+		case a.distributedLog == nil || srv.RpcAddr == leaderAddr:
+			// without Raft, every server appends the records produced to it
+			srv.Role = api.ServerRole_ROLE_LEADER
+		default:
+			srv.Role = api.ServerRole_ROLE_FOLLOWER
+		}
+		servers = append(servers, srv)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Id < servers[j].Id
+	})
+	return servers, nil
+}
+
+// SharedOffsets reports whether the agents hold the records at the same offsets, which they do
+// when replicating with Raft, while each agent pulling the others' records appends them at
+// offsets of its own
+func (a *Agent) SharedOffsets() bool {
+	return a.distributedLog != nil
+}
+
+// ReplicationStatus reports how far the agent is in replicating each of the other agents.
+// It's empty for agents replicating with Raft.
+func (a *Agent) ReplicationStatus() map[string]log.PeerStatus {
+	if a.replicator == nil {
+		return nil
+	}
+	return a.replicator.Peers()
+}
+
+// serve serves the connections of the RPC address until the agent shuts down
+func (a *Agent) serve() {
+	if err := a.mux.Serve(); err != nil {
+		_ = a.Shutdown()
+	}
+}
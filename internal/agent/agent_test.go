@@ -1,16 +1,461 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
 	"github.com/pandulaDW/go-distributed-service/internal/config"
+	"github.com/pandulaDW/go-distributed-service/internal/loadbalance"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestAgent(t *testing.T) {
-	config.SetupTLSConfig(config.TLSConfig{
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.ServerCertFile,
 		KeyFile:       config.ServerKeyFile,
 		CAFile:        config.CAFile,
 		ServerAddress: "127.0.0.1",
 		Server:        true,
 	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+
+	root, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(root)
+
+	ports := dynaport.Get(2)
+	agent, err := New(Config{
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+		DataDirs:        []string{filepath.Join(root, "disk-0"), filepath.Join(root, "disk-1")},
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:         ports[1],
+		NodeName:        "0",
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, agent.Shutdown())
+	}()
+
+	// the log is placed in one of the data directories
+	var logs []string
+	for _, u := range agent.DataDirUsage() {
+		require.NoError(t, u.Err)
+		logs = append(logs, u.Logs...)
+	}
+	require.Equal(t, []string{logName}, logs)
+
+	client, closeClient := client(t, agent, peerTLSConfig)
+	defer closeClient()
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consume.Record.Value)
+}
+
+func TestAgent_SetupFailure(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "agent-setup-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(dataDir)
+
+	ports := dynaport.Get(3)
+	agentConfig := Config{
+		DataDirs:      []string{dataDir},
+		BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:       ports[1],
+		NodeName:      "0",
+		ACLModelFile:  config.ACLModelFile,
+		ACLPolicyFile: config.ACLPolicyFile,
+		Role:          ObserverRole,
+		MirrorAddr:    "127.0.0.1:0",
+	}
+	_, err = New(agentConfig)
+	require.Error(t, err)
+
+	// the agent fails to join the cluster once everything else is set up, and releases it all
+	agentConfig.Role, agentConfig.MirrorAddr = VoterRole, ""
+	agentConfig.StartJoinAddrs = []string{fmt.Sprintf("127.0.0.1:%d", ports[2])}
+	_, err = New(agentConfig)
+	require.Error(t, err)
+
+	agentConfig.StartJoinAddrs = nil
+	agent, err := New(agentConfig)
+	require.NoError(t, err)
+	require.NoError(t, agent.Shutdown())
+}
+
+func TestAgent_Mirror(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+
+	// the agents run two clusters of their own, the second mirroring the first
+	var agents []*Agent
+	for i := 0; i < 2; i++ {
+		dataDir, err := ioutil.TempDir("", "agent-mirror-test")
+		require.NoError(t, err)
+		defer func(path string) {
+			_ = os.RemoveAll(path)
+		}(dataDir)
+
+		ports := dynaport.Get(2)
+		agentConfig := Config{
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			DataDirs:        []string{dataDir},
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			NodeName:        fmt.Sprintf("%d", i),
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+		}
+		if i == 1 {
+			agentConfig.MirrorAddr, err = agents[0].Config.RPCAddr()
+			require.NoError(t, err)
+			agentConfig.MirrorTLSConfig = peerTLSConfig
+			agentConfig.MirrorPrefixes = [][]byte{[]byte("orders-")}
+			agentConfig.Cluster, agentConfig.MirrorCluster = "eu", "us"
+		}
+		agent, err := New(agentConfig)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, agent.Shutdown())
+		}()
+		agents = append(agents, agent)
+	}
+	require.Nil(t, agents[0].Mirror())
+
+	remote, closeRemote := client(t, agents[0], peerTLSConfig)
+	defer closeRemote()
+	local, closeLocal := client(t, agents[1], peerTLSConfig)
+	defer closeLocal()
+	ctx := context.Background()
+	for _, value := range []string{"payments-1", "orders-1"} {
+		_, err = remote.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return agents[1].Mirror().Offset() == 2
+	}, 3*time.Second, 10*time.Millisecond)
+	consume, err := local.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("orders-1"), consume.Record.Value)
+	off, ok := agents[1].Mirror().Translate(0)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), off)
+}
+
+func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) (api.LogClient, func()) {
+	t.Helper()
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, opts...)
+	require.NoError(t, err)
+	return api.NewLogClient(conn), func() {
+		_ = conn.Close()
+	}
+}
+
+func TestAgent_PullReplication(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+
+	var agents []*Agent
+	// the last agent observes the three others
+	for i := 0; i < 4; i++ {
+		ports := dynaport.Get(2)
+		dataDir, err := ioutil.TempDir("", "agent-pull-test")
+		require.NoError(t, err)
+		defer func(path string) {
+			_ = os.RemoveAll(path)
+		}(dataDir)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
+		}
+
+		agentConfig := Config{
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			DataDirs:        []string{dataDir},
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			Zone:            fmt.Sprintf("zone-%d", i%2),
+		}
+		if i == 3 {
+			agentConfig.Role = ObserverRole
+		}
+		agent, err := New(agentConfig)
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+		}
+	}()
+	time.Sleep(time.Second)
+
+	// every log is copied to the other agents, which live in both zones, the observer aside
+	report := agents[0].PlacementReport()
+	require.Len(t, report, 3)
+	for _, p := range report {
+		require.Len(t, p.Replicas, 2)
+		require.Equal(t, []string{"zone-0", "zone-1"}, p.Zones)
+		require.False(t, p.SingleZone)
+	}
+
+	// the records are acknowledged once another agent copied them
+	ctx := context.Background()
+	for i, agent := range agents[:3] {
+		client, closeClient := client(t, agent, peerTLSConfig)
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+			Acks:   api.Acks_ACKS_ALL,
+		})
+		require.NoError(t, err)
+		closeClient()
+	}
+	time.Sleep(3 * time.Second)
+
+	// the observer only serves the reads, and the clients discover it as such
+	observerClient, closeObserver := client(t, agents[3], peerTLSConfig)
+	_, err = observerClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("refused")}})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	servers, err := observerClient.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, servers.Servers, 4)
+	for i, srv := range servers.Servers {
+		role := api.ServerRole_ROLE_LEADER
+		if i == 3 {
+			role = api.ServerRole_ROLE_OBSERVER
+		}
+		require.Equal(t, role, srv.Role)
+		require.Equal(t, fmt.Sprintf("zone-%d", i%2), srv.Zone)
+		require.True(t, srv.Healthy)
+	}
+	closeObserver()
+
+	// every agent has each record once, rather than copies of copies
+	for _, agent := range agents {
+		client, closeClient := client(t, agent, peerTLSConfig)
+		values := make(map[string]bool)
+		for off := uint64(0); off < 3; off++ {
+			consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off})
+			require.NoError(t, err)
+			values[string(consume.Record.Value)] = true
+		}
+		require.Len(t, values, 3)
+		_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+		require.Error(t, err)
+		closeClient()
+
+		// and is caught up with the others, which don't copy the observer's empty log
+		peers := agent.ReplicationStatus()
+		if agent.Config.Role == ObserverRole {
+			require.Len(t, peers, 3)
+		} else {
+			require.Len(t, peers, 2)
+		}
+		for _, peer := range peers {
+			require.Equal(t, uint64(0), peer.Lag)
+		}
+	}
+}
+
+func TestAgent_RaftReplication(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dataDir, err := ioutil.TempDir("", "agent-raft-test")
+		require.NoError(t, err)
+		defer func(path string) {
+			_ = os.RemoveAll(path)
+		}(dataDir)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
+		}
+
+		agent, err := New(Config{
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			DataDirs:        []string{dataDir},
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ReplicationMode: RaftReplication,
+			Bootstrap:       i == 0,
+			RedirectWrites:  i == 2,
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+		}
+	}()
+
+	leaderClient, closeLeader := client(t, agents[0], peerTLSConfig)
+	defer closeLeader()
+	ctx := context.Background()
+	produce, err := leaderClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}})
+	require.NoError(t, err)
+
+	// the followers apply the record once the leader committed it
+	for _, agent := range agents[1:] {
+		followerClient, closeFollower := client(t, agent, peerTLSConfig)
+		require.Eventually(t, func() bool {
+			consume, err := followerClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+			return err == nil && bytes.Equal([]byte("foo"), consume.Record.Value)
+		}, 3*time.Second, 100*time.Millisecond)
+		closeFollower()
+	}
+
+	// the clients discover the leader from any agent
+	followerClient, closeFollower := client(t, agents[1], peerTLSConfig)
+	defer closeFollower()
+	servers, err := followerClient.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, servers.Servers, 3)
+	for i, srv := range servers.Servers {
+		rpcAddr, err := agents[i].Config.RPCAddr()
+		require.NoError(t, err)
+		require.Equal(t, rpcAddr, srv.RpcAddr)
+		role := api.ServerRole_ROLE_FOLLOWER
+		if i == 0 {
+			role = api.ServerRole_ROLE_LEADER
+		}
+		require.Equal(t, role, srv.Role)
+	}
+
+	// a follower forwards the produce requests to the leader
+	produce, err = followerClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("bar")}})
+	require.NoError(t, err)
+	consume, err := leaderClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), consume.Record.Value)
+
+	bulk, err := followerClient.ProduceBulkRecords(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, bulk.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("bulk")}}))
+	}
+	bulkRes, err := bulk.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), bulkRes.NumRecordsInserted)
+	require.Equal(t, uint64(produce.Offset+4), agents[0].distributedLog.HighWatermark())
+
+	// unless it redirects the clients to the leader
+	redirectClient, closeRedirect := client(t, agents[2], peerTLSConfig)
+	defer closeRedirect()
+	leaderAddr, err := agents[0].Config.RPCAddr()
+	require.NoError(t, err)
+	_, err = redirectClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("baz")}})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, err.Error(), leaderAddr)
+
+	// clients resolving the cluster from that agent produce to the leader anyway, and consume
+	// from the followers
+	redirectAddr, err := agents[2].Config.RPCAddr()
+	require.NoError(t, err)
+	lbConn, err := grpc.Dial(fmt.Sprintf("%s:///%s", loadbalance.Name, redirectAddr),
+		grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer lbConn.Close()
+	lbClient := api.NewLogClient(lbConn)
+	produce, err = lbClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("balanced")}})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		consume, err := lbClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+		return err == nil && bytes.Equal([]byte("balanced"), consume.Record.Value)
+	}, 3*time.Second, 100*time.Millisecond)
 }
@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
 	"net"
@@ -15,9 +16,23 @@ type Config struct {
 
 // Handler represents some component in this service that needs to know
 // when a server joins or leaves the cluster.
+//
+// Fail is called when a server stops responding without leaving the cluster, such as when it
+// crashed, and Update when a server changes its tags, such as its address. A failed server
+// that recovers joins the cluster again, and a failed one that doesn't is eventually reaped,
+// which is handled like it left.
 type Handler interface {
 	Join(name, addr string) error
 	Leave(name string) error
+	Fail(name string) error
+	Update(name, addr string) error
+}
+
+// ObserverHandler is implemented by the handlers telling the observers, the read-only servers
+// advertising ObserverRole, apart from the other servers. The observers joining the cluster are
+// passed to JoinObserver instead of Join.
+type ObserverHandler interface {
+	JoinObserver(name, addr string) error
 }
 
 // Membership is the type wrapping Serf to provide discovery and cluster
@@ -74,6 +89,7 @@ func (m *Membership) setupSerf() (err error) {
 	if m.StartJoinAddrs != nil {
 		_, err = m.serf.Join(m.StartJoinAddrs, true)
 		if err != nil {
+			_ = m.serf.Shutdown()
 			return err
 		}
 	}
@@ -83,30 +99,44 @@ func (m *Membership) setupSerf() (err error) {
 
 // eventHandler runs in a loop reading events sent by Serf into the events channel, handling
 // each incoming event according to the event’s type. When a node joins or leaves the cluster,
-// Serf sends an event to all nodes, including the node that joined or left the cluster
+// Serf sends an event to all nodes, including the node that joined or left the cluster, so
+// the events of the local member are skipped. The loop runs for the membership's lifetime.
 func (m *Membership) eventHandler() {
 	for e := range m.events {
-		switch e.EventType() {
+		event, ok := e.(serf.MemberEvent)
+		if !ok {
+			// user events and queries aren't about the membership
+			continue
+		}
+
+		var handle func(serf.Member)
+		switch event.EventType() {
 		case serf.EventMemberJoin:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					continue
-				}
-				m.handleJoin(member)
-			}
-		case serf.EventMemberLeave:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					return
-				}
-				m.handleLeave(member)
+			handle = m.handleJoin
+		case serf.EventMemberLeave, serf.EventMemberReap:
+			handle = m.handleLeave
+		case serf.EventMemberFailed:
+			handle = m.handleFail
+		case serf.EventMemberUpdate:
+			handle = m.handleUpdate
+		default:
+			continue
+		}
+		for _, member := range event.Members {
+			if m.isLocal(member) {
+				continue
 			}
+			handle(member)
 		}
 	}
 }
 
 func (m *Membership) handleJoin(member serf.Member) {
-	if err := m.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
+	join := m.handler.Join
+	if h, ok := m.handler.(ObserverHandler); ok && member.Tags[RoleTag] == ObserverRole {
+		join = h.JoinObserver
+	}
+	if err := join(member.Name, member.Tags["rpc_addr"]); err != nil {
 		m.logError(err, "failed to join", member)
 	}
 }
@@ -117,6 +147,18 @@ func (m *Membership) handleLeave(member serf.Member) {
 	}
 }
 
+func (m *Membership) handleFail(member serf.Member) {
+	if err := m.handler.Fail(member.Name); err != nil {
+		m.logError(err, "failed to handle the failure", member)
+	}
+}
+
+func (m *Membership) handleUpdate(member serf.Member) {
+	if err := m.handler.Update(member.Name, member.Tags["rpc_addr"]); err != nil {
+		m.logError(err, "failed to update", member)
+	}
+}
+
 // isLocal returns whether the given Serf member is the local member by
 // checking the members’ names
 func (m *Membership) isLocal(member serf.Member) bool {
@@ -135,7 +177,12 @@ func (m *Membership) Members() []serf.Member {
 
 // LogError logs the given error and message
 func (m *Membership) logError(err error, msg string, member serf.Member) {
-	m.logger.Error(
+	log := m.logger.Error
+	if err == raft.ErrNotLeader {
+		// only the Raft leader can change the cluster, so the followers expectedly fail to
+		log = m.logger.Debug
+	}
+	log(
 		msg, zap.Error(err),
 		zap.String("name", member.Name),
 		zap.String("rpc_addr", member.Tags["rpc_addr"]),
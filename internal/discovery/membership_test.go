@@ -19,6 +19,8 @@ func TestMembership(t *testing.T) {
 			3 == len(m[0].Members()) &&
 			0 == len(h.leaves)
 	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, []Node{{Name: "0", Zone: "zone-0"}, {Name: "1", Zone: "zone-1"}, {Name: "2", Zone: "zone-0"}},
+		m[0].Nodes())
 
 	require.NoError(t, m[2].Leave())
 
@@ -28,13 +30,52 @@ func TestMembership(t *testing.T) {
 			serf.StatusLeft == m[0].Members()[2].Status &&
 			1 == len(h.leaves)
 	}, 3*time.Second, 250*time.Millisecond)
+
+	// a member changing its tags is updated
+	tags := m[1].Tags
+	tags["rpc_addr"] = "127.0.0.1:0"
+	require.NoError(t, m[1].serf.SetTags(tags))
+	require.Eventually(t, func() bool {
+		return 1 == len(h.updates)
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, map[string]string{"id": "1", "addr": "127.0.0.1:0"}, <-h.updates)
+
+	// and a member that stops responding fails, without leaving
+	require.NoError(t, m[1].serf.Shutdown())
+	require.Eventually(t, func() bool {
+		return 1 == len(h.fails) &&
+			1 == len(h.leaves)
+	}, 15*time.Second, 250*time.Millisecond)
+	require.Equal(t, "1", <-h.fails)
+}
+
+func TestMembershipObserver(t *testing.T) {
+	m, h := setupMember(t, nil)
+	m, _ = setupMemberWithRole(t, m, ObserverRole)
+
+	// the observer joins the handler as one
+	require.Eventually(t, func() bool {
+		return 0 == len(h.joins) &&
+			1 == len(h.observers) &&
+			2 == len(m[0].Members())
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, "1", <-h.observers)
+	require.Equal(t, []Node{{Name: "0", Zone: "zone-0"}, {Name: "1", Zone: "zone-1", Role: ObserverRole}},
+		m[0].Nodes())
 }
 
 func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
+	return setupMemberWithRole(t, members, "")
+}
+
+func setupMemberWithRole(t *testing.T, members []*Membership, role string) ([]*Membership, *handler) {
 	id := len(members)
 	ports := dynaport.Get(1)
 	addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
-	tags := map[string]string{"rpc_addr": addr}
+	tags := map[string]string{"rpc_addr": addr, ZoneTag: fmt.Sprintf("zone-%d", id%2)}
+	if role != "" {
+		tags[RoleTag] = role
+	}
 
 	c := Config{
 		NodeName: fmt.Sprintf("%d", id),
@@ -45,6 +86,9 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler)
 	h := &handler{}
 	if len(members) == 0 {
 		h.joins = make(chan map[string]string, 3)
+		h.observers = make(chan string, 3)
+		h.fails = make(chan string, 3)
+		h.updates = make(chan map[string]string, 3)
 		h.leaves = make(chan string, 3)
 	} else {
 		c.StartJoinAddrs = []string{
@@ -59,8 +103,11 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler)
 }
 
 type handler struct {
-	joins  chan map[string]string
-	leaves chan string
+	joins     chan map[string]string
+	observers chan string
+	leaves    chan string
+	fails     chan string
+	updates   chan map[string]string
 }
 
 func (h *handler) Join(id, addr string) error {
@@ -73,9 +120,33 @@ func (h *handler) Join(id, addr string) error {
 	return nil
 }
 
+func (h *handler) JoinObserver(id, _ string) error {
+	if h.observers != nil {
+		h.observers <- id
+	}
+	return nil
+}
+
 func (h *handler) Leave(id string) error {
 	if h.leaves != nil {
 		h.leaves <- id
 	}
 	return nil
 }
+
+func (h *handler) Fail(id string) error {
+	if h.fails != nil {
+		h.fails <- id
+	}
+	return nil
+}
+
+func (h *handler) Update(id, addr string) error {
+	if h.updates != nil {
+		h.updates <- map[string]string{
+			"id":   id,
+			"addr": addr,
+		}
+	}
+	return nil
+}
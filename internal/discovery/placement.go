@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"hash/fnv"
+	"sort"
+)
+
+// The tags the members advertise their location and role with
+const (
+	RackTag = "rack"
+	ZoneTag = "zone"
+	RoleTag = "role"
+)
+
+// ObserverRole is the role advertised by the observers, the read-only servers copying every
+// log without being assigned replicas
+const ObserverRole = "observer"
+
+// Node is a member of the cluster, where it's located and its role
+type Node struct {
+	Name string
+	Rack string
+	Zone string
+	Role string
+}
+
+// Observer reports whether the node is an observer
+func (n Node) Observer() bool {
+	return n.Role == ObserverRole
+}
+
+// Nodes returns the members of the cluster that are alive, sorted by name
+func (m *Membership) Nodes() []Node {
+	var nodes []Node
+	for _, member := range m.serf.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		nodes = append(nodes, Node{
+			Name: member.Name,
+			Rack: member.Tags[RackTag],
+			Zone: member.Tags[ZoneTag],
+			Role: member.Tags[RoleTag],
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+// PlaceReplicas picks the n nodes that hold the replicas of the owner's log, among the other
+// nodes, the observers excepted. The replicas are spread across as many zones as possible,
+// the owner's included, and then across as many racks. Each owner starts picking from a
+// different node, so that the replicas of the logs spread over the cluster.
+//
+// The placement only depends on the nodes, so the nodes seeing the same members compute the
+// same one. It changes as the members do, a failed replica being replaced by another node.
+func PlaceReplicas(owner Node, nodes []Node, n int) []Node {
+	var candidates []Node
+	for _, node := range nodes {
+		if node.Name != owner.Name && !node.Observer() {
+			candidates = append(candidates, node)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	if len(candidates) > 0 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(owner.Name))
+		start := int(h.Sum32() % uint32(len(candidates)))
+		candidates = append(candidates[start:], candidates[:start]...)
+	}
+
+	zones := map[string]int{owner.Zone: 1}
+	racks := map[string]int{owner.Zone + "/" + owner.Rack: 1}
+	var replicas []Node
+	for len(replicas) < n && len(candidates) > 0 {
+		best := 0
+		for i, c := range candidates {
+			b := candidates[best]
+			if zones[c.Zone] < zones[b.Zone] ||
+				(zones[c.Zone] == zones[b.Zone] && racks[c.Zone+"/"+c.Rack] < racks[b.Zone+"/"+b.Rack]) {
+				best = i
+			}
+		}
+		picked := candidates[best]
+		candidates = append(candidates[:best], candidates[best+1:]...)
+		zones[picked.Zone]++
+		racks[picked.Zone+"/"+picked.Rack]++
+		replicas = append(replicas, picked)
+	}
+	return replicas
+}
+
+// LogPlacement reports where the copies of a node's log live: on the node itself and on its
+// replicas. SingleZone flags the logs whose copies all live in one zone, which an outage of
+// the zone would make unavailable.
+type LogPlacement struct {
+	Log        string
+	Replicas   []Node
+	Zones      []string
+	SingleZone bool
+}
+
+// PlacementReport places the n replicas of the log of each of the nodes, and reports where
+// their copies live. With n set to 0, every node holds a replica of every other node's log.
+// The observers hold no log of their own, and aren't reported as replicas.
+func PlacementReport(nodes []Node, n int) []LogPlacement {
+	if n == 0 {
+		n = len(nodes)
+	}
+
+	report := make([]LogPlacement, 0, len(nodes))
+	for _, owner := range nodes {
+		if owner.Observer() {
+			continue
+		}
+		p := LogPlacement{Log: owner.Name, Replicas: PlaceReplicas(owner, nodes, n)}
+		zones := map[string]bool{owner.Zone: true}
+		for _, replica := range p.Replicas {
+			zones[replica.Zone] = true
+		}
+		for zone := range zones {
+			p.Zones = append(p.Zones, zone)
+		}
+		sort.Strings(p.Zones)
+		p.SingleZone = len(p.Zones) == 1
+		report = append(report, p)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Log < report[j].Log
+	})
+	return report
+}
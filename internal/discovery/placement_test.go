@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPlaceReplicas(t *testing.T) {
+	nodes := []Node{
+		{Name: "a1", Rack: "r1", Zone: "a"},
+		{Name: "a2", Rack: "r1", Zone: "a"},
+		{Name: "a3", Rack: "r2", Zone: "a"},
+		{Name: "b1", Rack: "r1", Zone: "b"},
+		{Name: "c1", Rack: "r1", Zone: "c"},
+	}
+
+	// the replicas go to the other zones first, then to another rack of the owner's zone
+	replicas := PlaceReplicas(nodes[0], nodes, 3)
+	require.Len(t, replicas, 3)
+	require.ElementsMatch(t, []string{"b", "c", "a"}, []string{replicas[0].Zone, replicas[1].Zone, replicas[2].Zone})
+	require.Contains(t, replicas, nodes[2])
+
+	// every node computes the same placement, whatever the order of the nodes
+	reversed := []Node{nodes[4], nodes[3], nodes[2], nodes[1], nodes[0]}
+	require.Equal(t, replicas, PlaceReplicas(nodes[0], reversed, 3))
+
+	// a failed replica is replaced by another node
+	var alive []Node
+	for _, node := range nodes {
+		if node.Name != replicas[0].Name {
+			alive = append(alive, node)
+		}
+	}
+	replaced := PlaceReplicas(nodes[0], alive, 3)
+	require.Len(t, replaced, 3)
+	require.NotContains(t, replaced, replicas[0])
+
+	// there are only so many other nodes, and the observers aren't assigned replicas
+	require.Len(t, PlaceReplicas(nodes[0], nodes, 10), 4)
+	observer := Node{Name: "d1", Zone: "d", Role: ObserverRole}
+	require.Len(t, PlaceReplicas(nodes[0], append(nodes, observer), 10), 4)
+}
+
+func TestPlacementReport(t *testing.T) {
+	nodes := []Node{
+		{Name: "a1", Zone: "a"},
+		{Name: "a2", Zone: "a"},
+		{Name: "a3", Zone: "a"},
+		{Name: "b1", Zone: "b"},
+	}
+
+	// with a single replica, b1 is picked for every log of zone a, and b1's log stays in zone a
+	report := PlacementReport(nodes, 1)
+	require.Len(t, report, 4)
+	for _, p := range report {
+		require.Len(t, p.Replicas, 1)
+		require.False(t, p.SingleZone)
+		require.Equal(t, []string{"a", "b"}, p.Zones)
+	}
+
+	// without zone b, every copy lives in zone a
+	report = PlacementReport(nodes[:3], 0)
+	require.Len(t, report[0].Replicas, 2)
+	require.True(t, report[0].SingleZone)
+
+	// nor are the observers' logs
+	report = PlacementReport(append(nodes[:3:3], Node{Name: "b2", Zone: "b", Role: ObserverRole}), 0)
+	require.Len(t, report, 3)
+	require.True(t, report[0].SingleZone)
+}
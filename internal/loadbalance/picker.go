@@ -0,0 +1,108 @@
+package loadbalance
+
+import (
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{}))
+}
+
+// pickerBuilder builds a Picker whenever the servers the client is connected to change
+type pickerBuilder struct{}
+
+// Build sorts the servers the client is connected to by the role the Resolver resolved them with
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	var c cluster
+	var leaders, followers, observers []balancer.SubConn
+	addrs := make(map[balancer.SubConn]string, len(info.ReadySCs))
+	for sc, scInfo := range info.ReadySCs {
+		c, _ = scInfo.Address.Attributes.Value(clusterKey).(cluster)
+		addrs[sc] = scInfo.Address.Addr
+		role, _ := scInfo.Address.Attributes.Value(roleKey).(api.ServerRole)
+		switch role {
+		case api.ServerRole_ROLE_LEADER:
+			leaders = append(leaders, sc)
+		case api.ServerRole_ROLE_OBSERVER:
+			observers = append(observers, sc)
+		default:
+			followers = append(followers, sc)
+		}
+	}
+
+	p := &Picker{writers: leaders, readers: append(followers, observers...)}
+	// the followers only take the produce calls while no leader is elected, not while the
+	// client is still connecting to it
+	if len(p.writers) == 0 && !c.leader {
+		p.writers = followers
+	}
+	if len(p.readers) == 0 {
+		p.readers = leaders
+	}
+	if !c.sharedOffsets && c.reader != nil && len(addrs) > 0 {
+		// any server serves the reads, the one pinned being kept as the others come and go
+		all := append(append(leaders, followers...), observers...)
+		p.readers = []balancer.SubConn{c.reader.pick(all, addrs)}
+	}
+	return p
+}
+
+// pinnedReader is the server a client reads from when every server has offsets of its own
+type pinnedReader struct {
+	mu   sync.Mutex
+	addr string
+}
+
+// pick returns the pinned server among the readers, pinning one of them while the client isn't
+// connected to the pinned server anymore
+func (r *pinnedReader) pick(readers []balancer.SubConn, addrs map[balancer.SubConn]string) balancer.SubConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, sc := range readers {
+		if addrs[sc] == r.addr {
+			return sc
+		}
+	}
+	// the readers come in no particular order, which spreads the clients across the servers
+	r.addr = addrs[readers[0]]
+	return readers[0]
+}
+
+// Picker picks the server each call of the client goes to. The produce calls go to the leader,
+// or spread across the leaders when every server appends the records produced to it, and to
+// the followers forwarding them to the leader while there's none. The other calls, such as the
+// consume calls, spread across the followers and the observers, and go to the leader while
+// there's none.
+//
+// The servers pulling the records of the others hold them at offsets of their own, so the
+// client's reads are then pinned to one of them instead of being spread, until the client
+// isn't connected to it anymore.
+type Picker struct {
+	writers []balancer.SubConn
+	readers []balancer.SubConn
+	current uint64
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+// Pick picks the server of the call
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	candidates := p.readers
+	if strings.Contains(info.FullMethodName, "Produce") {
+		candidates = p.writers
+	}
+
+	var result balancer.PickResult
+	if len(candidates) == 0 {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	cur := atomic.AddUint64(&p.current, 1)
+	result.SubConn = candidates[cur%uint64(len(candidates))]
+	return result, nil
+}
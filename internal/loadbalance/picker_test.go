@@ -0,0 +1,154 @@
+package loadbalance
+
+import (
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"testing"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := (&pickerBuilder{}).Build(base.PickerBuildInfo{})
+	for _, method := range []string{"/log.v1.Log/Produce", "/log.v1.Log/Consume"} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupPicker(api.ServerRole_ROLE_LEADER, api.ServerRole_ROLE_FOLLOWER,
+		api.ServerRole_ROLE_FOLLOWER, api.ServerRole_ROLE_OBSERVER)
+	info := balancer.PickInfo{FullMethodName: "/log.v1.Log/Produce"}
+	for i := 0; i < 5; i++ {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], gotPick.SubConn)
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupPicker(api.ServerRole_ROLE_LEADER, api.ServerRole_ROLE_FOLLOWER,
+		api.ServerRole_ROLE_FOLLOWER, api.ServerRole_ROLE_OBSERVER)
+	info := balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"}
+	picked := make(map[balancer.SubConn]int)
+	for i := 0; i < 6; i++ {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		picked[gotPick.SubConn]++
+	}
+	// the calls spread evenly across the followers and the observer
+	require.Equal(t, map[balancer.SubConn]int{subConns[1]: 2, subConns[2]: 2, subConns[3]: 2}, picked)
+}
+
+func TestPickerFallsBack(t *testing.T) {
+	// without a leader, the followers forward the produce calls to it
+	picker, subConns := setupPicker(api.ServerRole_ROLE_FOLLOWER)
+	gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/ProduceStream"})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], gotPick.SubConn)
+
+	// and without followers, the leader serves the consume calls
+	picker, subConns = setupPicker(api.ServerRole_ROLE_LEADER)
+	gotPick, err = picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/ConsumeStream"})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], gotPick.SubConn)
+}
+
+func TestPickerWaitsForLeader(t *testing.T) {
+	// the followers don't take the produce calls while the client connects to the leader
+	picker, _ := setupClusterPicker(cluster{sharedOffsets: true, leader: true}, api.ServerRole_ROLE_FOLLOWER)
+	_, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Produce"})
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+}
+
+func TestPickerPinsReads(t *testing.T) {
+	// the servers pulling the records of the others have offsets of their own
+	c := cluster{leader: true, reader: &pinnedReader{}}
+	picker, subConns := setupClusterPicker(c, api.ServerRole_ROLE_LEADER, api.ServerRole_ROLE_LEADER,
+		api.ServerRole_ROLE_LEADER)
+	info := balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"}
+	gotPick, err := picker.Pick(info)
+	require.NoError(t, err)
+	pinned := gotPick.SubConn
+	for i := 0; i < 5; i++ {
+		gotPick, err = picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, pinned, gotPick.SubConn)
+	}
+
+	// while the produce calls still spread across the servers
+	picked := make(map[balancer.SubConn]bool)
+	for i := 0; i < 3; i++ {
+		gotPick, err = picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Produce"})
+		require.NoError(t, err)
+		picked[gotPick.SubConn] = true
+	}
+	require.Len(t, picked, 3)
+
+	// the client stays pinned as the other servers come and go
+	var kept int
+	for i, sc := range subConns {
+		if sc == pinned {
+			kept = i
+		}
+	}
+	for i := 0; i < 5; i++ {
+		picker, subConns = setupClusterPicker(c, api.ServerRole_ROLE_LEADER, api.ServerRole_ROLE_LEADER,
+			api.ServerRole_ROLE_LEADER, api.ServerRole_ROLE_OBSERVER)
+		gotPick, err = picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[kept], gotPick.SubConn)
+	}
+
+	// and repinned once it isn't
+	c.reader.addr = "127.0.0.1:0"
+	picker, subConns = setupClusterPicker(c, api.ServerRole_ROLE_LEADER)
+	gotPick, err = picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], gotPick.SubConn)
+	require.Equal(t, "127.0.0.1:9000", c.reader.addr)
+}
+
+// setupPicker builds a picker for the servers of a cluster replicating with Raft
+func setupPicker(roles ...api.ServerRole) (balancer.Picker, []*subConn) {
+	c := cluster{sharedOffsets: true}
+	for _, role := range roles {
+		if role == api.ServerRole_ROLE_LEADER {
+			c.leader = true
+		}
+	}
+	return setupClusterPicker(c, roles...)
+}
+
+func setupClusterPicker(c cluster, roles ...api.ServerRole) (balancer.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for i, role := range roles {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Addr:       fmt.Sprintf("127.0.0.1:%d", 9000+i),
+			Attributes: attributes.New(roleKey, role, clusterKey, c),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	return (&pickerBuilder{}).Build(buildInfo), subConns
+}
+
+// subConn implements balancer.SubConn
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
@@ -0,0 +1,218 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"sync"
+	"time"
+)
+
+// Name is the scheme of the resolver, and the name of the load balancer picking the servers.
+// Clients dial "log:///<seed address>" to be load balanced across the cluster.
+const Name = "log"
+
+// refreshInterval is how often the resolvers refresh the servers of the cluster
+var refreshInterval = 10 * time.Second
+
+// resolveTimeout is how long a resolver waits for the servers of the cluster
+const resolveTimeout = 5 * time.Second
+
+// attributeKey keys the attributes of the resolved addresses
+type attributeKey string
+
+// roleKey is the attribute holding the api.ServerRole of the resolved server, and clusterKey
+// the one holding what the cluster the server is part of tells the Picker
+const (
+	roleKey    attributeKey = "role"
+	clusterKey attributeKey = "cluster"
+)
+
+// cluster tells the Picker whether the servers hold the records at the same offsets, whether
+// a leader was resolved, and the server the client's reads are pinned to
+type cluster struct {
+	sharedOffsets bool
+	leader        bool
+	reader        *pinnedReader
+}
+
+func init() {
+	resolver.Register(&builder{})
+}
+
+// builder builds a Resolver for each client connection dialing the Name scheme
+type builder struct{}
+
+// Build creates a Resolver bootstrapping from the seed server the target's endpoint is the
+// address of, dialed with the credentials of the client connection
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (
+	resolver.Resolver, error) {
+	r := &Resolver{
+		clientConn: cc,
+		seed:       target.Endpoint,
+		serviceConfig: cc.ParseServiceConfig(
+			fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+		),
+		reader: &pinnedReader{},
+		logger: zap.L().Named("resolver"),
+		close:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if opts.DialCreds != nil {
+		r.dialOptions = append(r.dialOptions, grpc.WithTransportCredentials(opts.DialCreds))
+	}
+
+	var err error
+	r.resolverConn, err = grpc.Dial(r.seed, r.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	go r.refresh()
+	return r, nil
+}
+
+// Scheme returns the scheme the builder's resolvers resolve
+func (b *builder) Scheme() string {
+	return Name
+}
+
+// Resolver resolves the servers of the cluster with the GetServers RPC, starting from the seed
+// server and refreshing them every refreshInterval, or when the client connection asks to. The
+// healthy servers are passed to the client connection along with their role, for the Picker to
+// pick from.
+//
+// The servers are asked without holding the resolver's lock, so that a resolution waiting for
+// unreachable servers doesn't hold up the other calls of the client connection. The resolutions
+// are numbered as they start, and one finishing after a later one is dropped, so that the
+// servers it got don't replace newer ones.
+//
+// When the seed server can't be reached, the servers resolved last are asked instead, so that
+// the client keeps following the cluster after the seed server is gone.
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	seed          string
+	dialOptions   []grpc.DialOption
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	servers       []string
+	started       uint64
+	applied       uint64
+	reader        *pinnedReader
+	logger        *zap.Logger
+	close         chan struct{}
+	done          chan struct{}
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// ResolveNow resolves the servers of the cluster, and updates the client connection with them
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	r.started++
+	resolution := r.started
+	last := append([]string(nil), r.servers...)
+	r.mu.Unlock()
+
+	res, err := r.getServers(last)
+	if err != nil {
+		r.mu.Lock()
+		stale := resolution < r.applied
+		r.mu.Unlock()
+		if stale {
+			return
+		}
+		r.logger.Error("failed to resolve the servers", zap.Error(err), zap.String("seed", r.seed))
+		r.clientConn.ReportError(err)
+		return
+	}
+
+	c := cluster{sharedOffsets: res.SharedOffsets, reader: r.reader}
+	for _, server := range res.Servers {
+		if server.Healthy && server.Role == api.ServerRole_ROLE_LEADER {
+			c.leader = true
+		}
+	}
+	var addrs []resolver.Address
+	var servers []string
+	for _, server := range res.Servers {
+		if !server.Healthy {
+			continue
+		}
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(roleKey, server.Role, clusterKey, c),
+		})
+		servers = append(servers, server.RpcAddr)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resolution < r.applied {
+		return
+	}
+	r.servers, r.applied = servers, resolution
+	r.clientConn.UpdateState(resolver.State{Addresses: addrs, ServiceConfig: r.serviceConfig})
+}
+
+// getServers asks the seed server for the servers of the cluster, or else the servers resolved
+// last, one after the other
+func (r *Resolver) getServers(last []string) (*api.GetServersResponse, error) {
+	res, err := getServers(r.resolverConn)
+	if err == nil {
+		return res, nil
+	}
+
+	for _, addr := range last {
+		if addr == r.seed {
+			continue
+		}
+		conn, dialErr := grpc.Dial(addr, r.dialOptions...)
+		if dialErr != nil {
+			continue
+		}
+		res, serverErr := getServers(conn)
+		_ = conn.Close()
+		if serverErr == nil {
+			return res, nil
+		}
+	}
+	return nil, err
+}
+
+func getServers(conn *grpc.ClientConn) (*api.GetServersResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	return api.NewLogClient(conn).GetServers(ctx, &api.GetServersRequest{})
+}
+
+// refresh resolves the servers every refreshInterval, until the resolver closes
+func (r *Resolver) refresh() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+// Close stops refreshing the servers, and closes the connection to the seed server
+func (r *Resolver) Close() {
+	close(r.close)
+	<-r.done
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close the connection to the seed server", zap.Error(err))
+	}
+}
@@ -0,0 +1,161 @@
+package loadbalance
+
+import (
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/pandulaDW/go-distributed-service/internal/auth"
+	"github.com/pandulaDW/go-distributed-service/internal/config"
+	"github.com/pandulaDW/go-distributed-service/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	servers := &serverGetter{servers: []*api.Server{
+		{Id: "leader", RpcAddr: "localhost:9001", Role: api.ServerRole_ROLE_LEADER, Healthy: true},
+		{Id: "follower", RpcAddr: "localhost:9002", Role: api.ServerRole_ROLE_FOLLOWER, Healthy: true},
+		{Id: "failed", RpcAddr: "localhost:9003", Role: api.ServerRole_ROLE_FOLLOWER, Healthy: false},
+	}}
+	srv, err := server.NewGRPCServer(&server.Config{
+		Authorizer:   auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		ServerGetter: servers,
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Stop()
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+	opts := resolver.BuildOptions{DialCreds: credentials.NewTLS(clientTLSConfig)}
+
+	conn := &clientConn{}
+	target := resolver.Target{Scheme: Name, Endpoint: l.Addr().String()}
+	r, err := (&builder{}).Build(target, conn, opts)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// the healthy servers are resolved along with their role, and what the cluster tells
+	c := cluster{leader: true, reader: r.(*Resolver).reader}
+	want := resolver.State{Addresses: []resolver.Address{
+		{Addr: "localhost:9001", Attributes: attributes.New(roleKey, api.ServerRole_ROLE_LEADER, clusterKey, c)},
+		{Addr: "localhost:9002", Attributes: attributes.New(roleKey, api.ServerRole_ROLE_FOLLOWER, clusterKey, c)},
+	}}
+	require.Equal(t, want, conn.state)
+
+	// and kept up to date
+	servers.set(servers.servers[1:])
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Len(t, conn.state.Addresses, 1)
+	require.Equal(t, "localhost:9002", conn.state.Addresses[0].Addr)
+	// without a leader, the followers take the produce calls
+	c.leader = false
+	require.Equal(t, c, conn.state.Addresses[0].Attributes.Value(clusterKey))
+
+	// a resolution finishing after a later one doesn't replace the servers the later one got
+	hold := make(chan struct{})
+	servers.hold(hold)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}()
+	require.Eventually(t, servers.held, time.Second, 10*time.Millisecond)
+	servers.set([]*api.Server{
+		{Id: "leader", RpcAddr: "localhost:9004", Role: api.ServerRole_ROLE_LEADER, Healthy: true},
+		{Id: "follower", RpcAddr: "localhost:9002", Role: api.ServerRole_ROLE_FOLLOWER, Healthy: true},
+	})
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	close(hold)
+	<-done
+	require.Len(t, conn.state.Addresses, 2)
+	require.Equal(t, "localhost:9004", conn.state.Addresses[0].Addr)
+}
+
+// serverGetter returns the servers it's set with, the call it's set to hold waiting until the
+// hold channel is closed
+type serverGetter struct {
+	mu      sync.Mutex
+	servers []*api.Server
+	holding chan struct{}
+}
+
+func (s *serverGetter) GetServers() ([]*api.Server, error) {
+	s.mu.Lock()
+	servers, holding := s.servers, s.holding
+	s.holding = nil
+	s.mu.Unlock()
+	if holding != nil {
+		<-holding
+	}
+	return servers, nil
+}
+
+func (s *serverGetter) set(servers []*api.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+}
+
+// hold makes the next call wait for the channel to be closed
+func (s *serverGetter) hold(c chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holding = c
+}
+
+// held tells whether a call took the hold
+func (s *serverGetter) held() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.holding == nil
+}
+
+// clientConn implements resolver.ClientConn
+type clientConn struct {
+	resolver.ClientConn
+	state resolver.State
+	err   error
+}
+
+func (c *clientConn) UpdateState(state resolver.State) {
+	c.state = state
+}
+
+func (c *clientConn) ReportError(err error) {
+	c.err = err
+}
+
+func (c *clientConn) NewAddress([]resolver.Address) {}
+
+func (c *clientConn) NewServiceConfig(string) {}
+
+func (c *clientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
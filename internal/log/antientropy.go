@@ -0,0 +1,209 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"sort"
+	"time"
+)
+
+// DigestLog digests the records of a log by origin, such as Log.Digests, so that the replicator
+// can verify the log holds the same records as the other servers' logs
+type DigestLog interface {
+	Digests(rangeSize uint64) ([]*api.OriginDigest, error)
+	ReadOrigin(origin string, start, end uint64) ([]*api.Record, error)
+}
+
+func (w *worker) setVerified(divergent []*api.DivergentRange) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.Divergent = divergent
+	w.status.Verified = time.Now()
+}
+
+// verifyPeer verifies the local log against the server's every VerifyInterval, until the server
+// leaves or the replicator closes
+func (r *Replicator) verifyPeer(w *worker) {
+	defer r.workers.Done()
+
+	ticker := time.NewTicker(r.VerifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.verify(w); err != nil && w.ctx.Err() == nil {
+			r.logError(err, "verifying the replica failed", w.addr)
+		}
+	}
+}
+
+// verify compares the digests of the local log with the ones of the server's log, recording the
+// ranges holding different records in the worker's status. When the server is RepairFrom, the
+// records it holds in those ranges and the local log doesn't are copied from it.
+//
+// The logs are append-only, so the records that differ in content are only reported.
+func (r *Replicator) verify(w *worker) error {
+	clientConn, err := grpc.Dial(w.addr, r.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer func(clientConn *grpc.ClientConn) {
+		_ = clientConn.Close()
+	}(clientConn)
+	client := api.NewLogClient(clientConn)
+
+	res, err := client.GetDigests(w.ctx, &api.GetDigestsRequest{RangeSize: r.DigestRangeSize})
+	if err != nil {
+		return err
+	}
+	local, err := r.Verify.Digests(r.DigestRangeSize)
+	if err != nil {
+		return err
+	}
+
+	divergent := compareDigests(local, res.Origins, r.DigestRangeSize)
+	w.setVerified(divergent)
+	if ctx, err := tag.New(context.Background(), tag.Upsert(peerKey, w.name)); err == nil {
+		stats.Record(ctx, divergentRanges.M(int64(len(divergent))))
+	}
+	for _, d := range divergent {
+		r.logger.Warn("replica diverged from the peer",
+			zap.String("addr", w.addr), zap.String("origin", d.Origin),
+			zap.Uint64("start", d.Start), zap.Uint64("end", d.End),
+			zap.Uint64("local_records", d.LocalRecords), zap.Uint64("peer_records", d.PeerRecords))
+	}
+
+	if w.name != r.RepairFrom {
+		return nil
+	}
+	for _, d := range divergent {
+		repaired, err := r.repair(w.ctx, client, d)
+		if err != nil {
+			return err
+		}
+		if repaired > 0 {
+			r.logger.Info("repaired the divergent range from the peer",
+				zap.String("addr", w.addr), zap.String("origin", d.Origin),
+				zap.Uint64("start", d.Start), zap.Uint64("end", d.End), zap.Int("records", repaired))
+		}
+	}
+	return nil
+}
+
+// repair appends the records of the divergent range the server holds and the local log doesn't,
+// returning how many it appended
+func (r *Replicator) repair(ctx context.Context, client api.LogClient, d *api.DivergentRange) (int, error) {
+	res, err := client.ReadOriginRange(ctx, &api.ReadOriginRangeRequest{Origin: d.Origin, Start: d.Start, End: d.End})
+	if err != nil {
+		return 0, err
+	}
+
+	r.copyMu.Lock()
+	defer r.copyMu.Unlock()
+
+	local, err := r.Verify.ReadOrigin(d.Origin, d.Start, d.End)
+	if err != nil {
+		return 0, err
+	}
+	held := make(map[uint64]bool, len(local))
+	for _, record := range local {
+		held[record.OriginOffset] = true
+	}
+
+	var batch []*api.Record
+	for _, record := range res.Records {
+		if held[record.OriginOffset] {
+			continue
+		}
+		held[record.OriginOffset] = true
+		batch = append(batch, record)
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	if _, err = r.LocalLog.AppendBatch(batch); err != nil {
+		return 0, err
+	}
+	return len(batch), nil
+}
+
+// compareDigests returns the ranges whose records differ between the local and the peer's
+// digests, sorted by origin and start.
+//
+// Only the ranges both logs hold in full are compared: the records past them may still be
+// replicating, and the ones before them removed by the retention of one of the logs.
+func compareDigests(local, peer []*api.OriginDigest, rangeSize uint64) []*api.DivergentRange {
+	peerOrigins := make(map[string]*api.OriginDigest, len(peer))
+	for _, o := range peer {
+		peerOrigins[o.Origin] = o
+	}
+
+	var divergent []*api.DivergentRange
+	for _, l := range local {
+		p, ok := peerOrigins[l.Origin]
+		if !ok {
+			continue
+		}
+
+		first, next := l.FirstOffset, l.NextOffset
+		if p.FirstOffset > first {
+			first = p.FirstOffset
+		}
+		if p.NextOffset < next {
+			next = p.NextOffset
+		}
+		// the first and last ranges are only partly held by one of the logs
+		first = (first + rangeSize - 1) / rangeSize * rangeSize
+		next = next / rangeSize * rangeSize
+
+		localRanges, peerRanges := rangesByStart(l), rangesByStart(p)
+		starts := make(map[uint64]bool)
+		for start := range localRanges {
+			starts[start] = true
+		}
+		for start := range peerRanges {
+			starts[start] = true
+		}
+
+		for start := range starts {
+			if start < first || start+rangeSize > next {
+				continue
+			}
+			lr, pr := localRanges[start], peerRanges[start]
+			if lr.GetRecords() == pr.GetRecords() && bytes.Equal(lr.GetDigest(), pr.GetDigest()) {
+				continue
+			}
+			divergent = append(divergent, &api.DivergentRange{
+				Origin:       l.Origin,
+				Start:        start,
+				End:          start + rangeSize,
+				LocalRecords: lr.GetRecords(),
+				PeerRecords:  pr.GetRecords(),
+			})
+		}
+	}
+
+	sort.Slice(divergent, func(i, j int) bool {
+		if divergent[i].Origin != divergent[j].Origin {
+			return divergent[i].Origin < divergent[j].Origin
+		}
+		return divergent[i].Start < divergent[j].Start
+	})
+	return divergent
+}
+
+func rangesByStart(o *api.OriginDigest) map[uint64]*api.RangeDigest {
+	ranges := make(map[uint64]*api.RangeDigest, len(o.Ranges))
+	for _, r := range o.Ranges {
+		ranges[r.Start] = r
+	}
+	return ranges
+}
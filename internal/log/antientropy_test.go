@@ -0,0 +1,34 @@
+package log
+
+import (
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCompareDigests(t *testing.T) {
+	local := []*api.OriginDigest{
+		{Origin: "a", FirstOffset: 0, NextOffset: 9, Ranges: []*api.RangeDigest{
+			{Start: 0, Records: 2, Digest: []byte("0")},
+			{Start: 2, Records: 1, Digest: []byte("2-")},
+			{Start: 6, Records: 2, Digest: []byte("6")},
+			{Start: 8, Records: 1, Digest: []byte("8")},
+		}},
+		{Origin: "local-only", NextOffset: 2, Ranges: []*api.RangeDigest{{Start: 0, Records: 2}}},
+	}
+	peer := []*api.OriginDigest{
+		{Origin: "a", FirstOffset: 1, NextOffset: 12, Ranges: []*api.RangeDigest{
+			{Start: 0, Records: 1, Digest: []byte("0'")},
+			{Start: 2, Records: 2, Digest: []byte("2")},
+			{Start: 4, Records: 2, Digest: []byte("4")},
+			{Start: 6, Records: 2, Digest: []byte("6")},
+			{Start: 8, Records: 2, Digest: []byte("8")},
+		}},
+	}
+
+	// the first range isn't held in full by the peer, and the last one by the local log
+	require.Equal(t, []*api.DivergentRange{
+		{Origin: "a", Start: 2, End: 4, LocalRecords: 1, PeerRecords: 2},
+		{Origin: "a", Start: 4, End: 6, LocalRecords: 0, PeerRecords: 2},
+	}, compareDigests(local, peer, 2))
+}
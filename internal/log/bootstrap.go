@@ -0,0 +1,262 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+// segmentChunkSize is the size of the chunks the segment files are shipped in
+const segmentChunkSize = 64 << 10
+
+// importExt is the extension of the segment files being imported, until they're complete
+const importExt = ".import"
+
+// ErrSegmentChecksumMismatch is returned when committing an imported segment whose files
+// don't match the checksum computed by the log that shipped them
+var ErrSegmentChecksumMismatch = errors.New("segment checksum mismatch")
+
+// shippedSegment is a sealed segment being shipped, with the size of its files when it was
+// picked, so that the segment's records are read as they are on disk
+type shippedSegment struct {
+	*segment
+	storeSize, indexSize int64
+}
+
+// ShipSegments sends the raw files of the sealed segments holding records from the given offset
+// on, oldest to newest, in chunks of the store followed by chunks of the index. The last chunk of
+// each segment carries its next offset and the checksum of its files.
+//
+// The active segment isn't shipped, since it's still being appended to. The records following
+// the last sealed segment are left to be copied record by record. The shipped segments are pinned
+// until they're sent, so that the retention or a truncation removing them meanwhile doesn't
+// close them while they're read.
+func (l *Log) ShipSegments(offset uint64, send func(*api.SegmentChunk) error) error {
+	l.mu.Lock()
+	var segments []shippedSegment
+	for _, s := range l.segments {
+		if s == l.activeSegment || s.nextOffset <= offset || s.nextOffset == s.baseOffset {
+			continue
+		}
+		s.pins++
+		segments = append(segments, shippedSegment{s, int64(s.store.size), int64(s.index.size)})
+	}
+	formatVersion := l.Config.Segment.FormatVersion
+	l.mu.Unlock()
+
+	for i, s := range segments {
+		err := s.ship(formatVersion, send)
+		l.mu.Lock()
+		if unpinErr := s.unpin(); err == nil {
+			err = unpinErr
+		}
+		if err != nil {
+			for _, rest := range segments[i+1:] {
+				_ = rest.unpin()
+			}
+		}
+		l.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ship sends the files of the segment as they were when it was picked
+func (s shippedSegment) ship(formatVersion uint32, send func(*api.SegmentChunk) error) error {
+	checksum := crc32.New(crcTable)
+	files := []struct {
+		file api.SegmentFile
+		r    io.Reader
+		size int64
+	}{
+		// the store's ReadAt flushes the records it still buffers
+		{api.SegmentFile_SEGMENT_STORE, io.NewSectionReader(s.store, 0, s.storeSize), s.storeSize},
+		{api.SegmentFile_SEGMENT_INDEX, io.NewSectionReader(s.index.file, 0, s.indexSize), s.indexSize},
+	}
+
+	for _, f := range files {
+		buf := make([]byte, segmentChunkSize)
+		read := int64(0)
+		for {
+			n, err := io.ReadFull(f.r, buf)
+			read += int64(n)
+			if n > 0 {
+				_, _ = checksum.Write(buf[:n])
+				chunk := &api.SegmentChunk{
+					BaseOffset:    s.baseOffset,
+					FormatVersion: formatVersion,
+					File:          f.file,
+					Data:          buf[:n],
+				}
+				if err := send(chunk); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// a truncation of the log cut the segment short while it was shipped
+		if read != f.size {
+			return fmt.Errorf("segment %d was truncated while it was shipped", s.baseOffset)
+		}
+	}
+
+	return send(&api.SegmentChunk{
+		BaseOffset:    s.baseOffset,
+		FormatVersion: formatVersion,
+		File:          api.SegmentFile_SEGMENT_INDEX,
+		Last:          true,
+		NextOffset:    s.nextOffset,
+		Checksum:      checksum.Sum32(),
+	})
+}
+
+// SegmentImport writes the files of a segment shipped from another log next to the segments
+// of the log, where Commit adds it to the log once the files are complete.
+type SegmentImport struct {
+	log          *Log
+	baseOffset   uint64
+	store, index *os.File
+	checksum     hash.Hash32
+}
+
+// ImportSegment starts importing the segment with the given base offset, shipped from a log
+// in the given format. Segments can only be imported into an empty log, or right after the
+// last segment imported into it.
+func (l *Log) ImportSegment(baseOffset uint64, formatVersion uint32) (*SegmentImport, error) {
+	if l.Config.ReadOnly {
+		return nil, ErrOpenedReadOnly
+	}
+	if formatVersion != l.Config.Segment.FormatVersion {
+		return nil, fmt.Errorf("can't import a segment in format version %d into a log in format version %d",
+			formatVersion, l.Config.Segment.FormatVersion)
+	}
+
+	i := &SegmentImport{log: l, baseOffset: baseOffset, checksum: crc32.New(crcTable)}
+	var err error
+	if i.store, err = os.Create(i.path(".store") + importExt); err != nil {
+		return nil, err
+	}
+	if i.index, err = os.Create(i.path(".index") + importExt); err != nil {
+		_ = i.Abort()
+		return nil, err
+	}
+	return i, nil
+}
+
+// path returns the path of the segment file with the given extension
+func (i *SegmentImport) path(ext string) string {
+	return path.Join(i.log.Dir, fmt.Sprintf("%d%s", i.baseOffset, ext))
+}
+
+// Write appends a chunk to one of the segment's files
+func (i *SegmentImport) Write(file api.SegmentFile, p []byte) error {
+	f := i.store
+	if file == api.SegmentFile_SEGMENT_INDEX {
+		f = i.index
+	}
+	if _, err := f.Write(p); err != nil {
+		return err
+	}
+	_, _ = i.checksum.Write(p)
+	return nil
+}
+
+// Commit checks the segment's files against the checksum and the next offset of the shipped
+// segment, and then adds the segment to the log, followed by a new active segment. The import
+// is aborted if it fails.
+func (i *SegmentImport) Commit(nextOffset uint64, checksum uint32) error {
+	if err := i.commit(nextOffset, checksum); err != nil {
+		_ = i.Abort()
+		return err
+	}
+	return nil
+}
+
+func (i *SegmentImport) commit(nextOffset uint64, checksum uint32) error {
+	if i.checksum.Sum32() != checksum {
+		return fmt.Errorf("%w for segment %d", ErrSegmentChecksumMismatch, i.baseOffset)
+	}
+
+	fi, err := i.index.Stat()
+	if err != nil {
+		return err
+	}
+	indexSize := uint64(fi.Size())
+	if indexSize != (nextOffset-i.baseOffset)*entWidth {
+		return fmt.Errorf("index of segment %d doesn't hold the records up to offset %d", i.baseOffset, nextOffset)
+	}
+	if indexSize > i.log.Config.Segment.MaxIndexBytes {
+		return fmt.Errorf("index of segment %d is larger than the log's max index bytes", i.baseOffset)
+	}
+
+	for _, f := range []*os.File{i.store, i.index} {
+		if err = f.Sync(); err != nil {
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+
+	l := i.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the log's active segment is empty, and is replaced by the imported one
+	active := l.activeSegment
+	if active.nextOffset != active.baseOffset || (len(l.segments) > 1 && active.baseOffset != i.baseOffset) {
+		return fmt.Errorf("can't import segment %d into a log ending at offset %d", i.baseOffset, active.nextOffset)
+	}
+	if err = active.Remove(); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment = l.segments[:len(l.segments)-1], nil
+
+	if err = i.install(); err != nil {
+		// the log gets back an empty active segment, so it can still be appended to
+		_ = os.Remove(i.path(".store"))
+		_ = os.Remove(i.path(".index"))
+		if restoreErr := l.newSegment(active.baseOffset); restoreErr != nil {
+			return fmt.Errorf("%w, and restoring the active segment failed: %s", err, restoreErr)
+		}
+		return err
+	}
+	return l.newSegment(nextOffset)
+}
+
+// install moves the imported files in place and opens the segment they make up
+func (i *SegmentImport) install() error {
+	for _, ext := range []string{".store", ".index"} {
+		if err := os.Rename(i.path(ext)+importExt, i.path(ext)); err != nil {
+			return err
+		}
+	}
+	return i.log.newSegment(i.baseOffset)
+}
+
+// Abort discards the files of the segment being imported
+func (i *SegmentImport) Abort() error {
+	var err error
+	for _, f := range []*os.File{i.store, i.index} {
+		if f == nil {
+			continue
+		}
+		_ = f.Close()
+		if rmErr := os.Remove(f.Name()); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package log
+
+import (
+	"errors"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestShipSegments(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Origin = "source"
+	source, cleanup := openTestLog(t, c)
+	defer cleanup()
+	for i := 0; i < 9; i++ {
+		_, err := source.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	var chunks []*api.SegmentChunk
+	err := source.ShipSegments(0, func(chunk *api.SegmentChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// a segment holds 2 records, and the active segment holding the last one isn't shipped
+	var last []*api.SegmentChunk
+	for _, chunk := range chunks {
+		if chunk.Last {
+			last = append(last, chunk)
+		}
+	}
+	require.Len(t, last, 4)
+	require.Equal(t, uint64(6), last[3].BaseOffset)
+	require.Equal(t, uint64(8), last[3].NextOffset)
+
+	dest, cleanup := openTestLog(t, Config{})
+	defer cleanup()
+	importChunks(t, dest, chunks)
+
+	require.Equal(t, uint64(8), dest.HighWatermark())
+	for off := uint64(0); off < 8; off++ {
+		record, err := dest.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+		require.Equal(t, "source", record.Origin)
+		require.Equal(t, off, record.OriginOffset)
+	}
+
+	// the records following the imported segments are appended to a new active segment
+	off, err := dest.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+
+	// the segments are only shipped from the given offset on
+	chunks = chunks[:0]
+	err = source.ShipSegments(5, func(chunk *api.SegmentChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), chunks[0].BaseOffset)
+
+	// the segments the retention removes while they're shipped are still shipped in full
+	removed := source.segments[0]
+	chunks = chunks[:0]
+	err = source.ShipSegments(0, func(chunk *api.SegmentChunk) error {
+		if len(chunks) == 0 {
+			require.NoError(t, source.Truncate(5))
+		}
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	require.NoError(t, err)
+	dest, cleanup = openTestLog(t, Config{})
+	defer cleanup()
+	importChunks(t, dest, chunks)
+	require.Equal(t, uint64(8), dest.HighWatermark())
+
+	// and closed once shipped
+	lowest, err := source.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+	_, err = removed.store.File.Stat()
+	require.Error(t, err)
+}
+
+func TestImportSegmentFails(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	source, cleanup := openTestLog(t, c)
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		_, err := source.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	var chunks []*api.SegmentChunk
+	err := source.ShipSegments(0, func(chunk *api.SegmentChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	require.NoError(t, err)
+	first, last := chunks[0], chunks[len(chunks)-1]
+
+	dest, cleanup := openTestLog(t, Config{})
+	defer cleanup()
+
+	// the files don't match the checksum
+	segment, err := dest.ImportSegment(first.BaseOffset, first.FormatVersion)
+	require.NoError(t, err)
+	require.NoError(t, segment.Write(api.SegmentFile_SEGMENT_STORE, []byte("corrupted")))
+	err = segment.Commit(last.NextOffset, last.Checksum)
+	require.True(t, errors.Is(err, ErrSegmentChecksumMismatch))
+
+	// the aborted import left nothing behind
+	files, err := ioutil.ReadDir(dest.Dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		require.NotContains(t, file.Name(), importExt)
+	}
+
+	// the log is no longer empty
+	_, err = dest.Append(&api.Record{Value: []byte("local")})
+	require.NoError(t, err)
+	segment, err = dest.ImportSegment(first.BaseOffset, first.FormatVersion)
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		require.NoError(t, segment.Write(chunk.File, chunk.Data))
+	}
+	require.Error(t, segment.Commit(last.NextOffset, last.Checksum))
+	record, err := dest.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("local"), record.Value)
+
+	// the segment is in another format
+	_, err = dest.ImportSegment(first.BaseOffset, FormatV1)
+	require.Error(t, err)
+}
+
+// importChunks imports the segments shipped in the chunks into the log
+func importChunks(t *testing.T, log *Log, chunks []*api.SegmentChunk) {
+	t.Helper()
+	var segment *SegmentImport
+	for _, chunk := range chunks {
+		var err error
+		if segment == nil {
+			segment, err = log.ImportSegment(chunk.BaseOffset, chunk.FormatVersion)
+			require.NoError(t, err)
+		}
+		require.NoError(t, segment.Write(chunk.File, chunk.Data))
+		if chunk.Last {
+			require.NoError(t, segment.Commit(chunk.NextOffset, chunk.Checksum))
+			segment = nil
+		}
+	}
+}
+
+// openTestLog opens a log in a new temporary directory, removed by the returned function
+func openTestLog(t *testing.T, c Config) (*Log, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bootstrap-test")
+	require.NoError(t, err)
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	return log, func() {
+		_ = log.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
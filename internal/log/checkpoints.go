@@ -0,0 +1,204 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// checkpointsFile is the name of the file holding the replication checkpoints of a log
+const checkpointsFile = "checkpoints.json"
+
+// Checkpoints durably records, for each peer, the offset of the next record of the peer's
+// log to replicate, so that a replicator resumes where it stopped instead of copying the
+// whole log again when it rejoins or restarts.
+//
+// It also records, for each origin node, the origin offset of the next of its records to
+// copy, so that a record reaching this node through several peers is only copied once.
+//
+// The checkpoints live in the directory of the log the records are copied to, so they
+// are removed along with it. They're only written to disk by Flush, after the log is synced,
+// so that they never account for records the log lost in a crash. The records the log kept
+// past the checkpoints written last are accounted for again by Recover.
+type Checkpoints struct {
+	mu    sync.Mutex
+	dir   string
+	state checkpointsState
+	dirty bool
+}
+
+// checkpointsState holds the checkpoints, along with the offset of the local log up to which
+// the records it holds are accounted for in Origins
+type checkpointsState struct {
+	Peers   map[string]uint64 `json:"peers"`
+	Origins map[string]uint64 `json:"origins"`
+	Log     uint64            `json:"log"`
+}
+
+// RecordReader reads the records of a log, such as Log
+type RecordReader interface {
+	HighWatermark() uint64
+	Read(uint64) (*api.Record, error)
+}
+
+// NewCheckpoints loads the checkpoints kept in dir
+func NewCheckpoints(dir string) (*Checkpoints, error) {
+	c := newMemoryCheckpoints()
+	c.dir = dir
+
+	b, err := ioutil.ReadFile(path.Join(dir, checkpointsFile))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &c.state); err != nil {
+		return nil, fmt.Errorf("invalid replication checkpoints in %s: %w", dir, err)
+	}
+	// the files written before a map was added, or holding it as null, leave it nil
+	if c.state.Peers == nil {
+		c.state.Peers = make(map[string]uint64)
+	}
+	if c.state.Origins == nil {
+		c.state.Origins = make(map[string]uint64)
+	}
+	return c, nil
+}
+
+// newMemoryCheckpoints creates checkpoints that are only kept in memory
+func newMemoryCheckpoints() *Checkpoints {
+	return &Checkpoints{state: checkpointsState{
+		Peers:   make(map[string]uint64),
+		Origins: make(map[string]uint64),
+	}}
+}
+
+// Offset returns the offset to resume replicating the peer's log from, which is 0 for a
+// peer that was never replicated
+func (c *Checkpoints) Offset(peer string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.Peers[peer]
+}
+
+// OriginOffset returns the origin offset of the next record of the origin node to copy.
+// The records with a lower origin offset were already copied.
+func (c *Checkpoints) OriginOffset(origin string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.Origins[origin]
+}
+
+// Set records that the peer's log was replicated up to the offset, excluded, and that the
+// records of each of the origins were copied up to their origin offset, excluded. The
+// checkpoints are written to disk by the next Flush.
+func (c *Checkpoints) Set(peer string, offset uint64, origins map[string]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state.Peers[peer] = offset
+	for origin, originOffset := range origins {
+		c.state.Origins[origin] = originOffset
+	}
+	c.dirty = true
+}
+
+// Flush writes the checkpoints to disk, if they changed since they were last written. The
+// records they account for must be durable before, so sync is called first to sync the log
+// they were copied to, and logOffset is the offset following the last of them in that log.
+//
+// The copies must be held off while flushing, so that the checkpoints account for exactly
+// the records before logOffset.
+func (c *Checkpoints) Flush(logOffset uint64, sync func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dir == "" || !c.dirty {
+		return nil
+	}
+	if err := sync(); err != nil {
+		return err
+	}
+	c.state.Log = logOffset
+	if err := c.write(); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Recover accounts for the records of the log following the ones the checkpoints written
+// last accounted for, moving the checkpoints of their origins past them, so that the records
+// a crash kept in the log while losing the latest checkpoints aren't copied again.
+//
+// The peers' checkpoints can't be recovered, so the records are fetched again from the peers,
+// and skipped.
+func (c *Checkpoints) Recover(l RecordReader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := l.HighWatermark()
+	for off := c.state.Log; off < end; off++ {
+		record, err := l.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// removed by the retention of the log
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if record.Origin != "" && record.OriginOffset >= c.state.Origins[record.Origin] {
+			c.state.Origins[record.Origin] = record.OriginOffset + 1
+			c.dirty = true
+		}
+	}
+	return nil
+}
+
+// write atomically and durably writes the checkpoints to disk, syncing the file before it
+// replaces the previous one and the directory after
+func (c *Checkpoints) write() error {
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(c.dir, checkpointsFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path.Join(c.dir, checkpointsFile)); err != nil {
+		return err
+	}
+	return syncDir(c.dir)
+}
+
+// syncDir syncs the directory, so that the files renamed into it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
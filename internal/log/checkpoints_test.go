@@ -0,0 +1,92 @@
+package log
+
+import (
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewCheckpoints(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), c.Offset("peer-1"))
+
+	c.Set("peer-1", 4, map[string]uint64{"peer-1": 4})
+	c.Set("peer-2", 7, map[string]uint64{"peer-1": 6, "peer-2": 5})
+	c.Set("peer-1", 5, nil)
+
+	// the checkpoints are only written once the log they account for is synced
+	synced := false
+	sync := func() error {
+		synced = true
+		return nil
+	}
+	require.NoError(t, c.Flush(0, sync))
+	require.True(t, synced)
+	synced = false
+	require.NoError(t, c.Flush(0, sync))
+	require.False(t, synced)
+
+	c, err = NewCheckpoints(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), c.Offset("peer-1"))
+	require.Equal(t, uint64(7), c.Offset("peer-2"))
+	require.Equal(t, uint64(6), c.OriginOffset("peer-1"))
+	require.Equal(t, uint64(5), c.OriginOffset("peer-2"))
+
+	// the records the log kept past the checkpoints written last are accounted for again
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for _, record := range []*api.Record{
+		{Origin: "peer-2", OriginOffset: 4},
+		{Origin: "peer-2", OriginOffset: 5},
+		{Origin: "peer-2", OriginOffset: 6},
+		{Origin: "peer-3", OriginOffset: 0},
+	} {
+		_, err = l.Append(record)
+		require.NoError(t, err)
+	}
+	c.Set("peer-2", 9, map[string]uint64{"peer-2": 6})
+	require.NoError(t, c.Flush(2, l.Sync))
+	c.Set("peer-2", 10, map[string]uint64{"peer-2": 7, "peer-3": 1})
+
+	c, err = NewCheckpoints(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), c.OriginOffset("peer-2"))
+	require.NoError(t, c.Recover(l))
+	require.Equal(t, uint64(9), c.Offset("peer-2"))
+	require.Equal(t, uint64(7), c.OriginOffset("peer-2"))
+	require.Equal(t, uint64(1), c.OriginOffset("peer-3"))
+	require.Equal(t, uint64(6), c.OriginOffset("peer-1"))
+
+	// the checkpoints aren't reported as a damaged file of the log
+	require.NoError(t, l.Close())
+	report, err := Check(dir)
+	require.NoError(t, err)
+	require.Empty(t, report.Issues)
+}
+
+func TestCheckpoints_MissingMaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a file written before the origins were checkpointed, or holding null maps
+	for _, content := range []string{`{"peers":{"peer-1":3}}`, `{"peers":null,"origins":null}`} {
+		err = ioutil.WriteFile(path.Join(dir, checkpointsFile), []byte(content), 0644)
+		require.NoError(t, err)
+
+		c, err := NewCheckpoints(dir)
+		require.NoError(t, err)
+		c.Set("peer-2", 4, map[string]uint64{"peer-2": 4})
+		require.Equal(t, uint64(4), c.Offset("peer-2"))
+		require.Equal(t, uint64(4), c.OriginOffset("peer-2"))
+	}
+}
@@ -1,9 +1,43 @@
 package log
 
+import (
+	"github.com/hashicorp/raft"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// FormatVersion is the on-disk format new logs are created in, and defaults to
+		// LatestFormat. Existing logs keep the format recorded in their manifest.
+		FormatVersion uint32
+		// MmapSealedStores memory-maps the store files of sealed segments, the ones that are
+		// no longer appended to, and serves their reads from the mapping instead of a syscall.
+		MmapSealedStores bool
+	}
+	Disk struct {
+		// MinFreeBytes is the free space the log's filesystem needs before a log that ran
+		// out of space leaves read-only mode. Defaults to the size of a full segment.
+		MinFreeBytes uint64
+		// OnFailure is called with the I/O errors of the log caused by a failing disk, so that
+		// the owner of the log's directory can stop using the disk. It's called with the log
+		// locked, so it must not call back into the log.
+		OnFailure func(err error)
+	}
+	// Origin is the name of the node the log belongs to. The records appended without an origin
+	// are stamped with it and their offset, so that they still tell where they were produced
+	// once the log's segments are shipped to other nodes.
+	Origin string
+	// ReadOnly opens an existing log without modifying any of its files, so that tools can
+	// read a log another process is writing to. Appends are rejected and Refresh picks up
+	// the records the writer appended since, once it flushed them to the store.
+	ReadOnly bool
+	// Raft configures a DistributedLog, which replicates the log with Raft instead of
+	// having each server pull the records of the others.
+	Raft struct {
+		raft.Config
+		StreamLayer *StreamLayer
+		Bootstrap   bool
 	}
 }
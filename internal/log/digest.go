@@ -0,0 +1,248 @@
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"sort"
+)
+
+// segmentDigest is the digest of a segment's records up to its next offset, by origin
+type segmentDigest struct {
+	rangeSize, nextOffset uint64
+	origins               map[string]*originDigest
+}
+
+// originDigest gathers the records of an origin, by range of origin offsets
+type originDigest struct {
+	first, next uint64
+	ranges      map[uint64]*rangeDigest
+}
+
+// rangeDigest sums the hashes of a range's records. The sum doesn't depend on the order the
+// records were added in, since the records repaired into a log are appended after the ones
+// that followed them, and the digests of a range's records in several segments add up.
+type rangeDigest struct {
+	records uint64
+	sum     [sha256.Size]byte
+}
+
+func newSegmentDigest(rangeSize, nextOffset uint64) *segmentDigest {
+	return &segmentDigest{rangeSize: rangeSize, nextOffset: nextOffset, origins: make(map[string]*originDigest)}
+}
+
+// add digests the record, hashed with its origin offset, in its origin's range
+func (d *segmentDigest) add(record *api.Record) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, record.OriginOffset)
+	h := sha256.New()
+	_, _ = h.Write(b)
+	_, _ = h.Write(record.Value)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+
+	o := d.origin(record.Origin, record.OriginOffset, record.OriginOffset+1)
+	start := record.OriginOffset / d.rangeSize * d.rangeSize
+	o.addRange(start, &rangeDigest{records: 1, sum: sum})
+}
+
+// merge adds the digest of another segment's records
+func (d *segmentDigest) merge(other *segmentDigest) {
+	for origin, od := range other.origins {
+		o := d.origin(origin, od.first, od.next)
+		for start, r := range od.ranges {
+			o.addRange(start, r)
+		}
+	}
+}
+
+// origin returns the digest of the origin, extended to the given origin offsets
+func (d *segmentDigest) origin(origin string, first, next uint64) *originDigest {
+	o, ok := d.origins[origin]
+	if !ok {
+		o = &originDigest{first: first, next: next, ranges: make(map[uint64]*rangeDigest)}
+		d.origins[origin] = o
+	}
+	if first < o.first {
+		o.first = first
+	}
+	if next > o.next {
+		o.next = next
+	}
+	return o
+}
+
+func (o *originDigest) addRange(start uint64, r *rangeDigest) {
+	sum, ok := o.ranges[start]
+	if !ok {
+		sum = &rangeDigest{}
+		o.ranges[start] = sum
+	}
+	sum.records += r.records
+	// the hashes are added as 256-bit big endian numbers, modulo 2^256
+	var carry uint16
+	for i := len(sum.sum) - 1; i >= 0; i-- {
+		carry += uint16(sum.sum[i]) + uint16(r.sum[i])
+		sum.sum[i] = byte(carry)
+		carry >>= 8
+	}
+}
+
+// Digests computes, for each origin of the log's records, the digests of the records in ranges of
+// rangeSize origin offsets. Each origin's records are found at the same origin offsets on every
+// node holding them, whatever their offsets there, so the digests of two logs can be compared to
+// tell whether they hold the same records.
+//
+// The digests of the sealed segments are cached, so only the records of the active segment and
+// of the segments created since the last call are read.
+//
+// The records appended without an origin are counted as records of Config.Origin.
+func (l *Log) Digests(rangeSize uint64) (_ []*api.OriginDigest, err error) {
+	segments, nextOffsets := l.pinSegments()
+	defer func() {
+		if unpinErr := l.unpinSegments(segments); err == nil {
+			err = unpinErr
+		}
+	}()
+
+	total := newSegmentDigest(rangeSize, 0)
+	for i, s := range segments {
+		d, err := l.digestSegment(s, nextOffsets[i], rangeSize)
+		if err != nil {
+			return nil, err
+		}
+		total.merge(d)
+	}
+
+	digests := make([]*api.OriginDigest, 0, len(total.origins))
+	for origin, o := range total.origins {
+		digest := &api.OriginDigest{Origin: origin, FirstOffset: o.first, NextOffset: o.next}
+		for start, r := range o.ranges {
+			digest.Ranges = append(digest.Ranges, &api.RangeDigest{
+				Start:   start,
+				Records: r.records,
+				Digest:  append([]byte(nil), r.sum[:]...),
+			})
+		}
+		sort.Slice(digest.Ranges, func(i, j int) bool {
+			return digest.Ranges[i].Start < digest.Ranges[j].Start
+		})
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i].Origin < digests[j].Origin
+	})
+	return digests, nil
+}
+
+// digestSegment returns the digest of the segment's records up to the given offset, from the
+// cache if the segment is sealed and was digested with the same range size
+func (l *Log) digestSegment(s *segment, nextOffset, rangeSize uint64) (*segmentDigest, error) {
+	l.mu.RLock()
+	cached := s.digest
+	l.mu.RUnlock()
+	if cached != nil && cached.rangeSize == rangeSize && cached.nextOffset == nextOffset {
+		return cached, nil
+	}
+
+	d := newSegmentDigest(rangeSize, nextOffset)
+	if err := l.scanSegment(s, nextOffset, d.add); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	if s != l.activeSegment && s.nextOffset == nextOffset {
+		s.digest = d
+	}
+	l.mu.Unlock()
+	return d, nil
+}
+
+// ReadOrigin returns the records of the origin with origin offsets from start to end, excluded,
+// in origin offset order. The sealed segments whose cached digest shows they hold no record of
+// the range aren't read.
+func (l *Log) ReadOrigin(origin string, start, end uint64) (_ []*api.Record, err error) {
+	segments, nextOffsets := l.pinSegments()
+	defer func() {
+		if unpinErr := l.unpinSegments(segments); err == nil {
+			err = unpinErr
+		}
+	}()
+
+	var records []*api.Record
+	for i, s := range segments {
+		l.mu.RLock()
+		cached := s.digest
+		l.mu.RUnlock()
+		if cached != nil {
+			if o, ok := cached.origins[origin]; !ok || o.next <= start || end <= o.first {
+				continue
+			}
+		}
+
+		err := l.scanSegment(s, nextOffsets[i], func(record *api.Record) {
+			if record.Origin == origin && start <= record.OriginOffset && record.OriginOffset < end {
+				records = append(records, record)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].OriginOffset < records[j].OriginOffset
+	})
+	return records, nil
+}
+
+// pinSegments pins the log's segments, returning them with their next offsets, so that they can
+// be read without holding the lock and even if the retention removes them meanwhile
+func (l *Log) pinSegments() ([]*segment, []uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segments := make([]*segment, len(l.segments))
+	nextOffsets := make([]uint64, len(l.segments))
+	for i, s := range l.segments {
+		s.pins++
+		segments[i], nextOffsets[i] = s, s.nextOffset
+	}
+	return segments, nextOffsets
+}
+
+func (l *Log) unpinSegments(segments []*segment) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	for _, s := range segments {
+		if unpinErr := s.unpin(); err == nil {
+			err = unpinErr
+		}
+	}
+	return err
+}
+
+// scanSegment calls fn with the records of the pinned segment up to the given offset, their
+// origin set to Config.Origin when they were appended without one. The records a truncation
+// removed from the segment meanwhile aren't scanned.
+func (l *Log) scanSegment(s *segment, nextOffset uint64, fn func(*api.Record)) error {
+	for off := s.baseOffset; off < nextOffset; off++ {
+		l.mu.RLock()
+		if off >= s.nextOffset {
+			l.mu.RUnlock()
+			return nil
+		}
+		record, err := s.Read(off)
+		err = l.checkDiskFailure(err)
+		l.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if record.Origin == "" {
+			record.Origin, record.OriginOffset = l.Config.Origin, record.Offset
+		}
+		fn(record)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package log
+
+import (
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDigests(t *testing.T) {
+	c := Config{}
+	c.Origin = "a"
+	a, cleanup := openTestLog(t, c)
+	defer cleanup()
+	b, cleanup := openTestLog(t, Config{})
+	defer cleanup()
+
+	// a holds its own records, b the copies of them, partly out of order
+	for i := 0; i < 5; i++ {
+		_, err := a.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+	for _, i := range []uint64{0, 1, 3, 2, 4} {
+		_, err := b.Append(&api.Record{Value: []byte{byte(i)}, Origin: "a", OriginOffset: i})
+		require.NoError(t, err)
+	}
+
+	digestsA, err := a.Digests(2)
+	require.NoError(t, err)
+	digestsB, err := b.Digests(2)
+	require.NoError(t, err)
+	require.Len(t, digestsA, 1)
+	require.Equal(t, "a", digestsA[0].Origin)
+	require.Equal(t, uint64(0), digestsA[0].FirstOffset)
+	require.Equal(t, uint64(5), digestsA[0].NextOffset)
+	require.Len(t, digestsA[0].Ranges, 3)
+	require.Equal(t, uint64(1), digestsA[0].Ranges[2].Records)
+	require.Equal(t, digestsA, digestsB)
+
+	// a record that differs changes the digest of its range only
+	_, err = b.Append(&api.Record{Value: []byte("other"), Origin: "a", OriginOffset: 5})
+	require.NoError(t, err)
+	_, err = a.Append(&api.Record{Value: []byte{5}})
+	require.NoError(t, err)
+	digestsA, err = a.Digests(2)
+	require.NoError(t, err)
+	digestsB, err = b.Digests(2)
+	require.NoError(t, err)
+	require.Equal(t, digestsA[0].Ranges[:2], digestsB[0].Ranges[:2])
+	require.NotEqual(t, digestsA[0].Ranges[2].Digest, digestsB[0].Ranges[2].Digest)
+
+	records, err := b.ReadOrigin("a", 2, 4)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(2), records[0].OriginOffset)
+	require.Equal(t, uint64(3), records[1].OriginOffset)
+}
+
+func TestDigests_SealedSegments(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Origin = "a"
+	a, cleanup := openTestLog(t, c)
+	defer cleanup()
+	b, cleanup := openTestLog(t, Config{})
+	defer cleanup()
+	for i := 0; i < 9; i++ {
+		_, err := a.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err := b.Append(&api.Record{Value: []byte("other"), Origin: "b", OriginOffset: 0})
+	require.NoError(t, err)
+	for i := uint64(0); i < 9; i++ {
+		_, err := b.Append(&api.Record{Value: []byte("hello world"), Origin: "a", OriginOffset: i})
+		require.NoError(t, err)
+	}
+
+	digestsA, err := a.Digests(4)
+	require.NoError(t, err)
+	digestsB, err := b.Digests(4)
+	require.NoError(t, err)
+	require.Equal(t, digestsA[0], digestsB[0])
+
+	// the digests of the sealed segments are cached, and the ones of the active segment aren't
+	for _, s := range a.segments {
+		require.Equal(t, s != a.activeSegment, s.digest != nil)
+	}
+	cached, err := a.Digests(4)
+	require.NoError(t, err)
+	require.Equal(t, digestsA, cached)
+
+	// the segments holding no record of the range aren't read
+	records, err := b.ReadOrigin("b", 0, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	records, err = b.ReadOrigin("a", 3, 6)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, uint64(3), records[0].OriginOffset)
+
+	// a truncated segment is digested again
+	require.NoError(t, a.TruncateFrom(3))
+	require.Nil(t, a.activeSegment.digest)
+	digestsA, err = a.Digests(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), digestsA[0].NextOffset)
+	require.Len(t, digestsA[0].Ranges, 1)
+	require.Equal(t, uint64(3), digestsA[0].Ranges[0].Records)
+}
@@ -0,0 +1,282 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DataDirs spreads logs across several data directories, usually one per disk, and keeps
+// track of the directories that failed so the logs on the remaining disks keep being served.
+//
+// Each log lives in a subdirectory named after it, inside one of the data directories. A
+// directory fails when creating or opening a log in it fails, or when one of its logs gets an
+// I/O error caused by the disk, and stays failed until the operator calls Recover once the
+// disk is fixed or replaced.
+type DataDirs struct {
+	mu     sync.Mutex
+	dirs   []string
+	failed map[string]error
+}
+
+// DirUsage reports how much of a data directory's filesystem is used, and by which logs.
+//
+// Err is set when the directory has failed, or its usage couldn't be read, in which case the
+// sizes are zero.
+type DirUsage struct {
+	Dir   string
+	Logs  []string
+	Used  uint64
+	Free  uint64
+	Total uint64
+	Err   error
+}
+
+// NewDataDirs creates the given data directories if they don't exist yet. Directories that
+// can't be created are marked as failed, and an error is only returned when none is usable.
+func NewDataDirs(dirs []string) (*DataDirs, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no data directory given")
+	}
+
+	d := &DataDirs{dirs: dirs, failed: make(map[string]error)}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			d.failed[dir] = err
+		}
+	}
+
+	if len(d.failed) == len(dirs) {
+		return nil, fmt.Errorf("none of the data directories %v are usable", dirs)
+	}
+	return d, nil
+}
+
+// Open opens the named log from the data directory holding it. A new log is created in the
+// healthy data directory with the most free space.
+//
+// A log that isn't found is only created when every data directory is healthy, since it may
+// otherwise live on a failed disk and recreating it elsewhere would silently lose its records.
+func (d *DataDirs) Open(name string, c Config) (*Log, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dir, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := NewLog(filepath.Join(dir, name), d.watch(dir, c))
+	if err != nil && isDiskFailure(err) {
+		d.fail(dir, err)
+	}
+	return l, err
+}
+
+// Path returns the directory of the named log, creating it the same way Open does, for
+// logs that manage their directory themselves.
+func (d *DataDirs) Path(name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dir, err := d.path(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// Watch returns the config of the log in the given directory, as returned by Path, with the
+// data directory holding it failing along with the log's disk
+func (d *DataDirs) Watch(path string, c Config) Config {
+	return d.watch(filepath.Dir(path), c)
+}
+
+func (d *DataDirs) watch(dir string, c Config) Config {
+	onFailure := c.Disk.OnFailure
+	c.Disk.OnFailure = func(err error) {
+		d.Fail(dir, err)
+		if onFailure != nil {
+			onFailure(err)
+		}
+	}
+	return c
+}
+
+// path returns the data directory holding the named log, after creating the log's
+// directory in it when it's a new log
+func (d *DataDirs) path(name string) (string, error) {
+	dir, err := d.locate(name)
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		if len(d.failed) > 0 {
+			return "", fmt.Errorf("log %q not found in the %d healthy data directories, it may be on a failed one",
+				name, len(d.dirs)-len(d.failed))
+		}
+		if dir, err = d.place(); err != nil {
+			return "", err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+		d.fail(dir, err)
+		return "", err
+	}
+	return dir, nil
+}
+
+// locate returns the data directory holding the named log, or an empty string if none does
+func (d *DataDirs) locate(name string) (string, error) {
+	for _, dir := range d.dirs {
+		if d.failed[dir] != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		switch {
+		case err == nil && info.IsDir():
+			return dir, nil
+		case err == nil:
+			return "", fmt.Errorf("%s is not a log directory", filepath.Join(dir, name))
+		case !os.IsNotExist(err):
+			d.fail(dir, err)
+		}
+	}
+	return "", nil
+}
+
+// place picks the healthy data directory with the most free space for a new log
+func (d *DataDirs) place() (string, error) {
+	var best string
+	var bestFree uint64
+	for _, dir := range d.dirs {
+		if d.failed[dir] != nil {
+			continue
+		}
+		free, _, err := diskSpace(dir)
+		if err != nil {
+			d.fail(dir, err)
+			continue
+		}
+		if best == "" || free > bestFree {
+			best, bestFree = dir, free
+		}
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("none of the data directories %v are usable", d.dirs)
+	}
+	return best, nil
+}
+
+// Fail marks the given data directory as failed, typically after a log stored in it
+// returned an I/O error. No new logs are placed in a failed directory.
+func (d *DataDirs) Fail(dir string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fail(dir, err)
+}
+
+func (d *DataDirs) fail(dir string, err error) {
+	if d.failed[dir] == nil {
+		d.failed[dir] = err
+	}
+}
+
+// Recover brings a failed data directory back into use, once the operator fixed or replaced
+// its disk. The directory is checked by writing and syncing a file in it first, and stays
+// failed if that fails.
+func (d *DataDirs) Recover(dir string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.failed[dir]; !ok {
+		return fmt.Errorf("%s is not a failed data directory", dir)
+	}
+	if err := probe(dir); err != nil {
+		return err
+	}
+	delete(d.failed, dir)
+	return nil
+}
+
+// probe checks that the data directory is usable by writing and syncing a file in it
+func probe(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return err
+	}
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(f.Name())
+
+	if _, err = f.Write([]byte("probe")); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Usage reports the disk usage of every data directory, in the order they were given. A
+// directory whose usage can't be read is reported with the error, but isn't failed for it,
+// since the error may well be transient.
+func (d *DataDirs) Usage() []DirUsage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	usage := make([]DirUsage, 0, len(d.dirs))
+	for _, dir := range d.dirs {
+		if err := d.failed[dir]; err != nil {
+			usage = append(usage, DirUsage{Dir: dir, Err: err})
+			continue
+		}
+		u, err := dirUsage(dir)
+		if err != nil {
+			u = DirUsage{Dir: dir, Err: err}
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// dirUsage computes the usage of a single data directory
+func dirUsage(dir string) (DirUsage, error) {
+	u := DirUsage{Dir: dir}
+
+	var err error
+	if u.Free, u.Total, err = diskSpace(dir); err != nil {
+		return u, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return u, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			u.Logs = append(u.Logs, entry.Name())
+		}
+	}
+
+	// the files are summed across the whole tree, the logs' own subdirectories included
+	err = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			u.Used += uint64(info.Size())
+		}
+		return nil
+	})
+	return u, err
+}
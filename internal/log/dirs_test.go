@@ -0,0 +1,117 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDataDirs(t *testing.T) {
+	root, err := ioutil.TempDir("", "data-dirs-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(root)
+
+	dirs := []string{filepath.Join(root, "disk-0"), filepath.Join(root, "disk-1")}
+	free := map[string]uint64{dirs[0]: 100, dirs[1]: 200}
+	defer func(fn func(string) (uint64, uint64, error)) {
+		diskSpace = fn
+	}(diskSpace)
+	diskSpace = func(dir string) (uint64, uint64, error) {
+		return free[dir], 1000, nil
+	}
+
+	d, err := NewDataDirs(dirs)
+	require.NoError(t, err)
+
+	// new logs are placed on the disk with the most free space
+	l, err := d.Open("first", Config{})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dirs[1], "first"), l.Dir)
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	free[dirs[0]] = 300
+	l, err = d.Open("second", Config{})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dirs[0], "second"), l.Dir)
+	require.NoError(t, l.Close())
+
+	// existing logs are reopened where they are
+	l, err = d.Open("first", Config{})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dirs[1], "first"), l.Dir)
+	read, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	require.NoError(t, l.Close())
+
+	usage := d.Usage()
+	require.Len(t, usage, 2)
+	require.Equal(t, []string{"second"}, usage[0].Logs)
+	require.Equal(t, []string{"first"}, usage[1].Logs)
+	require.Equal(t, uint64(300), usage[0].Free)
+	require.True(t, usage[1].Used > 0)
+
+	// the files nested in the logs' subdirectories are counted too
+	nested := filepath.Join(dirs[1], "first", "nested")
+	require.NoError(t, os.MkdirAll(nested, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(nested, "file"), make([]byte, 100), 0644))
+	require.Equal(t, usage[1].Used+100, d.Usage()[1].Used)
+	require.NoError(t, os.RemoveAll(nested))
+
+	// a usage that can't be read is reported without failing the directory
+	diskSpace = func(dir string) (uint64, uint64, error) {
+		return 0, 0, syscall.EINTR
+	}
+	require.Error(t, d.Usage()[0].Err)
+	diskSpace = func(dir string) (uint64, uint64, error) {
+		return free[dir], 1000, nil
+	}
+	require.NoError(t, d.Usage()[0].Err)
+
+	// an I/O error of a log caused by its disk fails the directory holding it, until recovered
+	l, err = d.Open("second", Config{})
+	require.NoError(t, err)
+	l.activeSegment.store.buf = bufio.NewWriter(failingDisk{File: l.activeSegment.store.File})
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.True(t, errors.Is(err, syscall.EIO))
+	require.NoError(t, l.Close())
+	require.Error(t, d.Usage()[0].Err)
+	_, err = d.Open("second", Config{})
+	require.Error(t, err)
+
+	require.NoError(t, d.Recover(dirs[0]))
+	require.NoError(t, d.Usage()[0].Err)
+	require.Error(t, d.Recover(dirs[0]))
+
+	// logs on the healthy disk keep being served when the other one fails
+	d.Fail(dirs[0], errors.New("disk failed"))
+	usage = d.Usage()
+	require.Error(t, usage[0].Err)
+	require.NoError(t, usage[1].Err)
+
+	l, err = d.Open("first", Config{})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	_, err = d.Open("second", Config{})
+	require.Error(t, err)
+}
+
+// failingDisk is a writer failing every write with EIO, like a failing disk
+type failingDisk struct {
+	*os.File
+}
+
+func (f failingDisk) Write([]byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.EIO}
+}
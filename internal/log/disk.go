@@ -0,0 +1,27 @@
+package log
+
+import (
+	"errors"
+	"syscall"
+)
+
+// diskSpace returns the number of bytes available to unprivileged users and the total
+// size of the filesystem holding dir. It's a variable so tests can simulate a full disk.
+var diskSpace = func(dir string) (free, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+// isOutOfSpace reports whether err was caused by the filesystem running out of space
+// or the user running out of quota.
+func isOutOfSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// isDiskFailure reports whether err was caused by a failing disk rather than by the data in it
+func isDiskFailure(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EROFS)
+}
@@ -0,0 +1,613 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DistributedLog replicates a log with Raft. Appends go through the leader, which commits
+// them once a quorum of servers stored them, and every server applies the committed
+// records to its own copy of the log, so reads are served locally.
+type DistributedLog struct {
+	config      Config
+	log         *Log
+	raft        *raft.Raft
+	logStore    *logStore
+	stableStore *raftboltdb.BoltStore
+}
+
+// NewDistributedLog creates the log and the Raft instance replicating it in dataDir
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	l := &DistributedLog{config: config}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		_ = l.log.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// setupLog creates the log holding the records the servers applied
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	var err error
+	l.log, err = NewLog(logDir, l.config)
+	return err
+}
+
+// setupRaft creates the Raft instance, which keeps its own log of commands next to
+// the stable store holding its term and vote, and its snapshots.
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	fsm := &fsm{log: l.log}
+
+	logDir := filepath.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	logConfig := l.config
+	// raft's log indexes start at 1
+	logConfig.Segment.InitialOffset = 1
+	logStore, err := newLogStore(logDir, logConfig)
+	if err != nil {
+		return err
+	}
+
+	stableStore, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft", "stable"))
+	if err != nil {
+		_ = logStore.Close()
+		return err
+	}
+
+	retain := 1
+	snapshotStore, err := raft.NewFileSnapshotStore(filepath.Join(dataDir, "raft"), retain, os.Stderr)
+	if err != nil {
+		_ = logStore.Close()
+		_ = stableStore.Close()
+		return err
+	}
+
+	maxPool := 5
+	timeout := 10 * time.Second
+	transport := raft.NewNetworkTransport(l.config.Raft.StreamLayer, maxPool, timeout, os.Stderr)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+
+	l.raft, err = raft.NewRaft(config, fsm, logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		_ = logStore.Close()
+		_ = stableStore.Close()
+		return err
+	}
+	l.logStore, l.stableStore = logStore, stableStore
+	fsm.setRaft(l.raft)
+
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+	// only the first server of a new cluster bootstraps it, the others join it
+	if err == nil && l.config.Raft.Bootstrap && !hasState {
+		config := raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}
+		err = l.raft.BootstrapCluster(config).Error()
+	}
+	if err != nil {
+		_ = l.raft.Shutdown().Error()
+		_ = logStore.Close()
+		_ = stableStore.Close()
+		return err
+	}
+	return nil
+}
+
+// Append appends the record to the log through the leader, returning its offset once
+// a quorum of servers stored it. It returns raft.ErrNotLeader on followers.
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	res, err := l.apply(AppendRequestType, &api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// apply encodes the request after its type, so the fsm knows how to apply it, and has
+// Raft replicate it and apply it once committed.
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interface{}, error) {
+	var buf bytes.Buffer
+	if _, err := buf.Write([]byte{byte(reqType)}); err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = buf.Write(b); err != nil {
+		return nil, err
+	}
+
+	timeout := 10 * time.Second
+	future := l.raft.Apply(buf.Bytes(), timeout)
+	if future.Error() != nil {
+		return nil, future.Error()
+	}
+
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Read reads the record at the offset from the local log. Reads are eventually
+// consistent, a follower may not have applied the latest records yet.
+func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
+	return l.log.Read(offset)
+}
+
+// HighWatermark returns the offset following the highest record of the local log
+func (l *DistributedLog) HighWatermark() uint64 {
+	return l.log.HighWatermark()
+}
+
+// Leader returns the address of the current leader, empty while none is elected, and whether
+// this server is the leader. The servers' Raft address is the one of their gRPC server.
+func (l *DistributedLog) Leader() (string, bool) {
+	return string(l.raft.Leader()), l.raft.State() == raft.Leader
+}
+
+// ReadOnly reports whether the local log ran out of space and rejects appends
+func (l *DistributedLog) ReadOnly() bool {
+	return l.log.ReadOnly()
+}
+
+// Join adds the server to the Raft cluster as a voter. Only the leader can add servers,
+// so it returns raft.ErrNotLeader on followers.
+func (l *DistributedLog) Join(id, addr string) error {
+	return l.join(id, addr, true)
+}
+
+// JoinObserver adds the server to the Raft cluster as a nonvoter, which replicates the log
+// but neither counts toward the quorum nor stands for election
+func (l *DistributedLog) JoinObserver(id, addr string) error {
+	return l.join(id, addr, false)
+}
+
+func (l *DistributedLog) join(id, addr string, voter bool) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// server has already joined
+				return nil
+			}
+			// remove the existing server, it rejoined with a different id or address
+			if err := l.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !voter {
+		return l.raft.AddNonvoter(serverID, serverAddr, 0, 0).Error()
+	}
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// Leave removes the server from the Raft cluster
+func (l *DistributedLog) Leave(id string) error {
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// Fail keeps the failed server in the Raft cluster, which tolerates the failures of a minority
+// of its servers, so that it catches up once it recovers. It's removed once it's reaped.
+func (l *DistributedLog) Fail(id string) error {
+	return nil
+}
+
+// Update moves the server of the Raft cluster to its new address, keeping it a voter or a
+// nonvoter. Only the leader can move servers, so it returns raft.ErrNotLeader on followers.
+func (l *DistributedLog) Update(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) && srv.Address != raft.ServerAddress(addr) {
+			return l.join(id, addr, srv.Suffrage == raft.Voter)
+		}
+	}
+	return nil
+}
+
+// WaitForLeader blocks until the cluster elected a leader or the timeout expires
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out")
+		case <-ticker.C:
+			if l := l.raft.Leader(); l != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// Close shuts down the Raft instance and closes the logs and the stable store
+func (l *DistributedLog) Close() error {
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := l.logStore.Close(); err != nil {
+		return err
+	}
+	if err := l.stableStore.Close(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+// RequestType identifies the kind of request a Raft command holds
+type RequestType uint8
+
+const (
+	AppendRequestType RequestType = 0
+)
+
+var _ raft.FSM = (*fsm)(nil)
+
+// fsm applies the committed Raft commands to the log. The other servers applied the commands
+// the fsm failed to apply, so it stops applying any command and shuts Raft down rather than
+// skipping one, which would leave its log with different records at the same offsets.
+type fsm struct {
+	log *Log
+
+	mu   sync.Mutex
+	raft *raft.Raft
+	err  error
+}
+
+// setRaft sets the Raft instance to shut down once a command fails to apply
+func (f *fsm) setRaft(r *raft.Raft) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.raft = r
+	if f.err != nil {
+		go r.Shutdown()
+	}
+}
+
+// halt stops the fsm from applying commands after err, shutting Raft down. Raft waits for
+// Apply to return when shutting down, so it's shut down from another goroutine.
+func (f *fsm) halt(err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = fmt.Errorf("log stopped applying the Raft commands: %w", err)
+		if f.raft != nil {
+			go f.raft.Shutdown()
+		}
+	}
+	return f.err
+}
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	f.mu.Lock()
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	buf := record.Data
+	reqType := RequestType(buf[0])
+	switch reqType {
+	case AppendRequestType:
+		return f.applyAppend(buf[1:])
+	}
+	return f.halt(fmt.Errorf("unknown request type %d", reqType))
+}
+
+func (f *fsm) applyAppend(b []byte) interface{} {
+	var req api.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return f.halt(err)
+	}
+	offset, err := f.log.Append(req.Record)
+	if err != nil {
+		return f.halt(err)
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+// Snapshot captures the records applied so far. Raft calls it from its own goroutine
+// while it keeps applying commands, so the snapshot stops at the current next offset.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	lowest, err := f.log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{log: f.log, lowest: lowest, next: f.log.HighWatermark()}, nil
+}
+
+// Restore replaces the log with the records of the snapshot, which keep their offsets
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+
+	reader := bufio.NewReader(r)
+	b := make([]byte, lenWidth)
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(reader, b)
+		if err == io.EOF && i == 0 {
+			// the snapshot was taken before any record was applied
+			f.log.Config.Segment.InitialOffset = 0
+			return f.log.Reset()
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		size := int64(enc.Uint64(b))
+		data := make([]byte, size)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(data, record); err != nil {
+			return err
+		}
+
+		if i == 0 {
+			f.log.Config.Segment.InitialOffset = record.Offset
+			if err = f.log.Reset(); err != nil {
+				return err
+			}
+		}
+		if _, err = f.log.Append(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+// snapshot writes the records between its offsets as their length followed by the record,
+// independently of the log's on-disk format.
+type snapshot struct {
+	log          *Log
+	lowest, next uint64
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	b := make([]byte, lenWidth)
+	for off := s.lowest; off < s.next; off++ {
+		record, err := s.log.Read(off)
+		if err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+		data, err := proto.Marshal(record)
+		if err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+		enc.PutUint64(b, uint64(len(data)))
+		if _, err = w.Write(b); err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+// logStore keeps Raft's own log in a Log, with each Raft log entry stored as a record
+// at the offset of the entry's index.
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{l}, nil
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	return l.HighestOffset()
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	if err != nil {
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// lets the leader send a snapshot to followers missing the entry
+			return raft.ErrLogNotFound
+		}
+		return err
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	for _, record := range records {
+		next := l.HighWatermark()
+		switch {
+		case record.Index < next:
+			// the entry replaces conflicting ones, which raft normally deletes first
+			if err := l.TruncateFrom(record.Index); err != nil {
+				return err
+			}
+		case record.Index > next:
+			// the entries before it are covered by a snapshot this server installed
+			l.Config.Segment.InitialOffset = record.Index
+			if err := l.Reset(); err != nil {
+				return err
+			}
+		}
+
+		if _, err := l.Append(&api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRange removes the entries between the offsets. Raft either compacts its log,
+// removing the oldest entries, or removes the newest entries conflicting with the leader's.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if min <= lowest {
+		return l.Truncate(max)
+	}
+	return l.TruncateFrom(min)
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// RaftRPC is the first byte of the connections Raft opens to its peers, so that they
+// can be told apart from the gRPC connections sharing the same port.
+const RaftRPC = 1
+
+// StreamLayer connects the Raft instances of the servers, encrypting the
+// connections with TLS when configured.
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+// NewStreamLayer creates a StreamLayer accepting the connections of the listener
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+// Dial makes an outgoing connection to another server's Raft instance
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	// identify to mux this is a raft rpc
+	if _, err = conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, nil
+}
+
+// Accept accepts the incoming connections of other servers' Raft instances
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 1)
+	if _, err = conn.Read(b); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
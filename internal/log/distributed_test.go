@@ -0,0 +1,191 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/raft"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMultipleNodes(t *testing.T) {
+	var logs []*DistributedLog
+	// the three voters are followed by an observer
+	nodeCount := 4
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer func() {
+			_ = l.Close()
+		}()
+
+		if i == 3 {
+			err = logs[0].JoinObserver(fmt.Sprintf("%d", i), ln.Addr().String())
+			require.NoError(t, err)
+		} else if i != 0 {
+			err = logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String())
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+		logs = append(logs, l)
+	}
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+
+		// every server applies the committed record at the same offset
+		require.Eventually(t, func() bool {
+			for j := 0; j < nodeCount; j++ {
+				got, err := logs[j].Read(off)
+				if err != nil {
+					return false
+				}
+				if !bytes.Equal(got.Value, record.Value) {
+					return false
+				}
+			}
+			return true
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	// followers can't append, only the leader can
+	_, err := logs[1].Append(&api.Record{Value: []byte("follower")})
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	// a server that left the cluster stops receiving records
+	err = logs[0].Leave("1")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	off, err := logs[0].Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	record, err := logs[1].Read(off)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.Nil(t, record)
+
+	record, err = logs[2].Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), record.Value)
+	require.Equal(t, off, record.Offset)
+
+	// the observer replicates without voting
+	record, err = logs[3].Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), record.Value)
+	configFuture := logs[0].raft.GetConfiguration()
+	require.NoError(t, configFuture.Error())
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == "3" {
+			require.Equal(t, raft.Nonvoter, srv.Suffrage)
+		} else {
+			require.Equal(t, raft.Voter, srv.Suffrage)
+		}
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 1
+	s, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var entries []*raft.Log
+	for i := uint64(1); i <= 5; i++ {
+		entries = append(entries, &raft.Log{Index: i, Term: 1, Data: []byte("entry")})
+	}
+	require.NoError(t, s.StoreLogs(entries))
+
+	first, err := s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	last, err := s.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), last)
+
+	var out raft.Log
+	require.NoError(t, s.GetLog(3, &out))
+	require.Equal(t, uint64(3), out.Index)
+	require.Equal(t, uint64(1), out.Term)
+
+	// a conflicting entry replaces the entries from its index on
+	require.NoError(t, s.DeleteRange(4, 5))
+	require.NoError(t, s.StoreLog(&raft.Log{Index: 4, Term: 2, Data: []byte("entry")}))
+	last, err = s.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), last)
+	require.NoError(t, s.GetLog(4, &out))
+	require.Equal(t, uint64(2), out.Term)
+
+	// entries after a snapshot start the store over at their index
+	require.NoError(t, s.StoreLog(&raft.Log{Index: 10, Term: 3, Data: []byte("entry")}))
+	first, err = s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), first)
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(4, &out))
+}
+
+func TestFSM_HaltsOnFailedApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	f := &fsm{log: l}
+
+	b, err := proto.Marshal(&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	data := append([]byte{byte(AppendRequestType)}, b...)
+	res := f.Apply(&raft.Log{Index: 1, Data: data})
+	require.Equal(t, uint64(0), res.(*api.ProduceResponse).Offset)
+
+	// once a command fails to apply, the next ones aren't applied either
+	_, ok := f.Apply(&raft.Log{Index: 2, Data: []byte{0xff}}).(error)
+	require.True(t, ok)
+	_, ok = f.Apply(&raft.Log{Index: 3, Data: data}).(error)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), l.HighWatermark())
+}
@@ -0,0 +1,225 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// On-disk format versions of a log. The version applies to every segment of the log and
+// is recorded in the log's manifest file.
+const (
+	// FormatV1 is the original format, where each record in the store is prefixed by its length.
+	// Logs without a manifest were written before versioning and are in this format.
+	FormatV1 uint32 = 1
+	// FormatV2 adds a CRC32 checksum of the record between its length and its bytes.
+	FormatV2 uint32 = 2
+	// LatestFormat is the format new logs are created in
+	LatestFormat = FormatV2
+)
+
+// manifestFile is the name of the file holding a log's manifest
+const manifestFile = "manifest.json"
+
+// manifest describes how a log is laid out on disk
+type manifest struct {
+	Version uint32 `json:"version"`
+}
+
+// readManifest reads the manifest of the log in dir. ok is false if the log doesn't have one.
+func readManifest(dir string) (m manifest, ok bool, err error) {
+	b, err := ioutil.ReadFile(path.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return m, false, fmt.Errorf("invalid manifest in %s: %w", dir, err)
+	}
+	if m.Version < FormatV1 || m.Version > LatestFormat {
+		return m, false, fmt.Errorf("unsupported log format version %d in %s", m.Version, dir)
+	}
+	return m, true, nil
+}
+
+// writeManifest atomically writes the manifest of the log in dir
+func writeManifest(dir string, m manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(dir, manifestFile+".tmp")
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, manifestFile))
+}
+
+// FormatVersion returns the on-disk format version of the log in dir without opening it
+func FormatVersion(dir string) (uint32, error) {
+	m, ok, err := readManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return FormatV1, nil
+	}
+	return m.Version, nil
+}
+
+// Migrate rewrites the log in dir to the latest format, keeping the offsets of its records.
+// It fails if another process has the log open.
+//
+// The records are copied to a new log next to dir, which then replaces it, so the original
+// log is left untouched if the migration fails halfway. The new segments keep the sizes of
+// the original ones, unless the config sets them.
+func Migrate(dir string, c Config) (err error) {
+	version, err := FormatVersion(dir)
+	if err != nil {
+		return err
+	}
+	if version == LatestFormat {
+		return nil
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := lock.Unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	// the original log is opened read-only, so its indexes aren't resized to the config's
+	src := c
+	src.ReadOnly = true
+	old, err := NewLog(dir, src)
+	if err != nil {
+		return err
+	}
+
+	storeBytes, indexBytes, err := segmentSizes(dir)
+	if err != nil {
+		_ = old.Close()
+		return err
+	}
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = storeBytes
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = indexBytes
+	}
+
+	tmpDir := dir + ".migrate"
+	err = copyLog(old, tmpDir, c)
+	if err == nil {
+		// the records keep their offsets, so the replication checkpoints still apply
+		err = copyFile(path.Join(dir, checkpointsFile), path.Join(tmpDir, checkpointsFile))
+	}
+	if closeErr := old.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	backup := dir + ".old"
+	if err = rename(dir, backup); err != nil {
+		return err
+	}
+	if err = rename(tmpDir, dir); err != nil {
+		// put the original log back, rather than leaving dir missing
+		if restoreErr := rename(backup, dir); restoreErr != nil {
+			return fmt.Errorf("%w, and restoring the log from %s failed: %s", err, backup, restoreErr)
+		}
+		return err
+	}
+	return os.RemoveAll(backup)
+}
+
+// segmentSizes returns the sizes of the largest store and index files of the log in dir, the
+// sizes its segments were written with being at least as large
+func segmentSizes(dir string) (storeBytes, indexBytes uint64, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, f := range files {
+		size := uint64(f.Size())
+		switch path.Ext(f.Name()) {
+		case ".store":
+			if size > storeBytes {
+				storeBytes = size
+			}
+		case ".index":
+			if size > indexBytes {
+				indexBytes = size
+			}
+		}
+	}
+	return storeBytes, indexBytes, nil
+}
+
+// rename renames a file or directory. It's a variable so tests can simulate a failed rename.
+var rename = os.Rename
+
+// copyFile copies the file at src to dst, if it exists
+func copyFile(src, dst string) error {
+	b, err := ioutil.ReadFile(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, b, 0644)
+}
+
+// copyLog copies every record of the given log to a new log in the latest format in dir
+func copyLog(src *Log, dir string, c Config) error {
+	lowest, err := src.LowestOffset()
+	if err != nil {
+		return err
+	}
+	highest, err := src.HighestOffset()
+	if err != nil {
+		return err
+	}
+
+	if err = os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err = os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	c.Segment.FormatVersion = LatestFormat
+	c.Segment.InitialOffset = lowest
+	dst, err := NewLog(dir, c)
+	if err != nil {
+		return err
+	}
+
+	// an empty log has its next offset at its lowest one
+	empty := src.HighWatermark() == lowest
+	for off := lowest; !empty && off <= highest; off++ {
+		record, err := src.Read(off)
+		if err != nil {
+			_ = dst.Close()
+			return err
+		}
+		if _, err = dst.Append(record); err != nil {
+			_ = dst.Close()
+			return err
+		}
+	}
+
+	return dst.Close()
+}
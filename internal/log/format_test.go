@@ -0,0 +1,162 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(dir)
+
+	// new logs are created in the latest format
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, LatestFormat, l.Config.Segment.FormatVersion)
+	require.NoError(t, l.Remove())
+
+	// write a log that predates versioning: FormatV1 and no manifest
+	require.NoError(t, os.Mkdir(dir, 0755))
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 5
+	c.Segment.FormatVersion = FormatV1
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+	require.NoError(t, os.Remove(path.Join(dir, manifestFile)))
+
+	version, err := FormatVersion(dir)
+	require.NoError(t, err)
+	require.Equal(t, FormatV1, version)
+
+	// the previous format is still readable
+	c.Segment.FormatVersion = 0
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, FormatV1, l.Config.Segment.FormatVersion)
+	read, err := l.Read(7)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world 2"), read.Value)
+	require.NoError(t, l.Close())
+
+	// and can be migrated to the latest one, keeping the offsets
+	require.NoError(t, Migrate(dir, c))
+	version, err = FormatVersion(dir)
+	require.NoError(t, err)
+	require.Equal(t, LatestFormat, version)
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, LatestFormat, l.Config.Segment.FormatVersion)
+	for i := 0; i < 5; i++ {
+		read, err = l.Read(uint64(5 + i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(5+i), read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), read.Value)
+	}
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), lowest)
+	require.NoError(t, l.Close())
+
+	_, err = os.Stat(dir + ".old")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMigrate_FailedRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+		_ = os.RemoveAll(path + ".migrate")
+	}(dir)
+
+	c := Config{}
+	c.Segment.FormatVersion = FormatV1
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// the migrated log fails to replace the original one
+	defer func(fn func(string, string) error) {
+		rename = fn
+	}(rename)
+	rename = func(from, to string) error {
+		if from == dir+".migrate" {
+			return errors.New("rename failed")
+		}
+		return os.Rename(from, to)
+	}
+	require.Error(t, Migrate(dir, Config{}))
+
+	// the original log is put back in place
+	version, err := FormatVersion(dir)
+	require.NoError(t, err)
+	require.Equal(t, FormatV1, version)
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	read, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	require.NoError(t, l.Close())
+	_, err = os.Stat(dir + ".old")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMigrate_LargeIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(dir)
+
+	// the index outgrows the default 1 KiB segment size
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 9000
+	c.Segment.FormatVersion = FormatV1
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	index, err := os.Stat(path.Join(dir, "0.index"))
+	require.NoError(t, err)
+	require.Equal(t, int64(200*entWidth), index.Size())
+
+	// the migrated segments aren't cut down to the default sizes
+	require.NoError(t, Migrate(dir, Config{}))
+	index, err = os.Stat(path.Join(dir, "0.index"))
+	require.NoError(t, err)
+	require.Greater(t, index.Size(), int64(1024))
+
+	c.Segment.FormatVersion = 0
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, LatestFormat, l.Config.Segment.FormatVersion)
+	for i := 0; i < 200; i++ {
+		read, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), read.Value)
+	}
+	require.NoError(t, l.Close())
+}
@@ -0,0 +1,340 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"google.golang.org/protobuf/proto"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CheckReport describes the segments of a log directory and the inconsistencies found in them
+type CheckReport struct {
+	Dir      string
+	Format   uint32
+	Segments []SegmentReport
+	Issues   []Issue
+}
+
+// SegmentReport describes a single segment of a checked log. NextOffset is the offset after
+// the last valid record, so the segment holds the offsets in [BaseOffset, NextOffset).
+type SegmentReport struct {
+	BaseOffset uint64
+	NextOffset uint64
+	StoreBytes int64
+	IndexBytes int64
+}
+
+// Issue is an inconsistency found in one of the files of a log directory. Repaired is set
+// when Repair fixed it.
+type Issue struct {
+	File     string
+	Problem  string
+	Repaired bool
+}
+
+// segmentFiles holds the names of the files making up a segment, which are empty when missing
+type segmentFiles struct {
+	baseOffset uint64
+	store      string
+	index      string
+}
+
+// Check inspects the log in dir without modifying it or opening it with NewLog, so it's safe
+// to run while another process is using the log. It reports every segment with its offset
+// range and sizes, along with the inconsistencies found:
+//   - index or store files missing their counterpart, and files that aren't part of a segment
+//   - index entries that don't match the records of the store, or point past its end
+//   - records that are truncated, fail their checksum or hold an unexpected offset
+//   - bytes at the end of a store that aren't indexed, and gaps between segments
+func Check(dir string) (*CheckReport, error) {
+	return check(dir, false)
+}
+
+// Repair checks the log in dir like Check does and fixes the issues it can, by rebuilding
+// the index of each segment from the valid records of its store, truncating the store after
+// them and removing index files without a store. It fails if the log is in use.
+func Repair(dir string) (*CheckReport, error) {
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	report, err := check(dir, true)
+	if unlockErr := lock.Unlock(); err == nil {
+		err = unlockErr
+	}
+	return report, err
+}
+
+func check(dir string, repair bool) (*CheckReport, error) {
+	format, err := FormatVersion(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &CheckReport{Dir: dir, Format: format}
+
+	segments, err := listSegments(dir, report)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, files := range segments {
+		if files.store == "" {
+			report.addIssue(files.index, "index file has no store file", repair)
+			if repair {
+				if err = os.Remove(path.Join(dir, files.index)); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		s, err := checkSegment(dir, files, format, report, repair)
+		if err != nil {
+			return nil, err
+		}
+
+		if n := len(report.Segments); n > 0 && report.Segments[n-1].NextOffset != s.BaseOffset {
+			report.addIssue(files.store, fmt.Sprintf("segment starts at offset %d but the previous one ends at %d",
+				s.BaseOffset, report.Segments[n-1].NextOffset), false)
+		}
+		report.Segments = append(report.Segments, s)
+	}
+
+	return report, nil
+}
+
+// listSegments groups the files of the log directory by segment, reporting the files that
+// don't belong to any segment
+func listSegments(dir string, report *CheckReport) ([]*segmentFiles, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byOffset := make(map[uint64]*segmentFiles)
+	for _, file := range files {
+		name := file.Name()
+		ext := path.Ext(name)
+		if name == manifestFile || name == lockFile || name == checkpointsFile {
+			continue
+		}
+
+		off, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 0)
+		if file.IsDir() || err != nil || (ext != ".store" && ext != ".index") {
+			report.addIssue(name, "file is not part of a segment", false)
+			continue
+		}
+
+		if byOffset[off] == nil {
+			byOffset[off] = &segmentFiles{baseOffset: off}
+		}
+		if ext == ".store" {
+			byOffset[off].store = name
+		} else {
+			byOffset[off].index = name
+		}
+	}
+
+	segments := make([]*segmentFiles, 0, len(byOffset))
+	for _, s := range byOffset {
+		segments = append(segments, s)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].baseOffset < segments[j].baseOffset
+	})
+	return segments, nil
+}
+
+// checkSegment checks a segment that has a store file, rebuilding its index and truncating
+// its store when repairing
+func checkSegment(dir string, files *segmentFiles, format uint32, report *CheckReport, repair bool) (SegmentReport, error) {
+	s := SegmentReport{BaseOffset: files.baseOffset, NextOffset: files.baseOffset}
+
+	storeBytes, err := ioutil.ReadFile(path.Join(dir, files.store))
+	if err != nil {
+		return s, err
+	}
+	s.StoreBytes = int64(len(storeBytes))
+
+	// the store is the source of truth, the valid records are the chain from its start
+	positions, end, problem := scanStore(storeBytes, files.baseOffset, format, nil)
+	s.NextOffset = files.baseOffset + uint64(len(positions))
+	storeDamaged := problem != ""
+	if storeDamaged {
+		report.addIssue(files.store, problem, repair)
+	} else if end < uint64(len(storeBytes)) {
+		storeDamaged = true
+		report.addIssue(files.store, fmt.Sprintf("%d bytes at the end of the store aren't a record",
+			uint64(len(storeBytes))-end), repair)
+	}
+
+	indexDamaged := files.index == ""
+	if indexDamaged {
+		files.index = fmt.Sprintf("%d.index", files.baseOffset)
+		report.addIssue(files.index, "store file has no index file", repair)
+	} else {
+		indexBytes, err := ioutil.ReadFile(path.Join(dir, files.index))
+		if err != nil {
+			return s, err
+		}
+		s.IndexBytes = int64(len(indexBytes))
+		if problem = checkIndex(indexBytes, positions, files.baseOffset); problem != "" {
+			indexDamaged = true
+			report.addIssue(files.index, problem, repair)
+		}
+	}
+
+	if !repair {
+		return s, nil
+	}
+	if storeDamaged {
+		if err = os.Truncate(path.Join(dir, files.store), int64(end)); err != nil {
+			return s, err
+		}
+		s.StoreBytes = int64(end)
+	}
+	if storeDamaged || indexDamaged {
+		index := make([]byte, uint64(len(positions))*entWidth)
+		for i, pos := range positions {
+			enc.PutUint32(index[uint64(i)*entWidth:], uint32(i))
+			enc.PutUint64(index[uint64(i)*entWidth+offWidth:], pos)
+		}
+		if err = ioutil.WriteFile(path.Join(dir, files.index), index, 0644); err != nil {
+			return s, err
+		}
+		s.IndexBytes = int64(len(index))
+	}
+	return s, nil
+}
+
+// scanStore walks the chain of records of a store, calling fn with each valid record if
+// it's not nil. It returns the position of every valid record, the end of the last one and
+// a description of the problem that stopped the walk before the end of the store, if any.
+func scanStore(b []byte, baseOffset uint64, format uint32, fn func(*api.Record) error) (
+	positions []uint64, end uint64, problem string,
+) {
+	headerWidth := uint64(lenWidth)
+	if format >= FormatV2 {
+		headerWidth += crcWidth
+	}
+
+	size := uint64(len(b))
+	for end < size {
+		off := baseOffset + uint64(len(positions))
+		if end+headerWidth > size {
+			return positions, end, fmt.Sprintf("record of offset %d at position %d has a truncated header", off, end)
+		}
+		recordEnd := end + headerWidth + enc.Uint64(b[end:])
+		if recordEnd > size || recordEnd < end {
+			return positions, end, fmt.Sprintf("record of offset %d at position %d is truncated", off, end)
+		}
+
+		p := b[end+headerWidth : recordEnd]
+		if format >= FormatV2 && crc32.Checksum(p, crcTable) != enc.Uint32(b[end+lenWidth:]) {
+			return positions, end, fmt.Sprintf("record of offset %d at position %d fails its checksum", off, end)
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return positions, end, fmt.Sprintf("record of offset %d at position %d can't be decoded: %v", off, end, err)
+		}
+		if record.Offset != off {
+			return positions, end, fmt.Sprintf("record at position %d holds offset %d instead of %d", end, record.Offset, off)
+		}
+
+		if fn != nil {
+			if err := fn(record); err != nil {
+				return positions, end, err.Error()
+			}
+		}
+		positions = append(positions, end)
+		end = recordEnd
+	}
+
+	return positions, end, ""
+}
+
+// checkIndex compares the entries of an index with the positions of the valid records of
+// its store, returning a description of the first mismatch.
+//
+// An index is truncated to its entries when its segment is closed, so trailing zeroed space
+// is reported as well since it means the log wasn't shut down cleanly.
+func checkIndex(b []byte, positions []uint64, baseOffset uint64) string {
+	if uint64(len(b))%entWidth != 0 {
+		return fmt.Sprintf("index size %d isn't a multiple of the entry size", len(b))
+	}
+
+	// the first entry is all zeros, so it's only told apart from unused space by the store
+	used := uint64(len(bytes.TrimRight(b, "\x00"))+int(entWidth)-1) / entWidth
+	if used == 0 && len(positions) > 0 && len(b) > 0 {
+		used = 1
+	}
+
+	for i := uint64(0); i < used; i++ {
+		entry := b[i*entWidth : (i+1)*entWidth]
+		off, pos := enc.Uint32(entry), enc.Uint64(entry[offWidth:])
+		switch {
+		case uint64(off) != i:
+			return fmt.Sprintf("index entry %d holds relative offset %d", i, off)
+		case i >= uint64(len(positions)):
+			return fmt.Sprintf("index entry of offset %d points past the last valid record of the store", baseOffset+i)
+		case pos != positions[i]:
+			return fmt.Sprintf("index entry of offset %d points to position %d instead of %d",
+				baseOffset+i, pos, positions[i])
+		}
+	}
+
+	switch {
+	case used < uint64(len(positions)):
+		return fmt.Sprintf("index is missing the entries of offsets %d to %d",
+			baseOffset+used, baseOffset+uint64(len(positions))-1)
+	case used*entWidth < uint64(len(b)):
+		return fmt.Sprintf("index has %d bytes of unused space, the log wasn't closed cleanly",
+			uint64(len(b))-used*entWidth)
+	}
+	return ""
+}
+
+// WalkRecords calls fn with every valid record of the log in dir, in offset order, without
+// modifying the log or opening it with NewLog. The walk stops at the first invalid record of
+// each segment, which Check reports.
+func WalkRecords(dir string, fn func(*api.Record) error) error {
+	format, err := FormatVersion(dir)
+	if err != nil {
+		return err
+	}
+	segments, err := listSegments(dir, &CheckReport{})
+	if err != nil {
+		return err
+	}
+
+	for _, files := range segments {
+		if files.store == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, files.store))
+		if err != nil {
+			return err
+		}
+
+		var walkErr error
+		scanStore(b, files.baseOffset, format, func(record *api.Record) error {
+			walkErr = fn(record)
+			return walkErr
+		})
+		if walkErr != nil {
+			return walkErr
+		}
+	}
+	return nil
+}
+
+func (r *CheckReport) addIssue(file, problem string, repaired bool) {
+	r.Issues = append(r.Issues, Issue{File: file, Problem: problem, Repaired: repaired})
+}
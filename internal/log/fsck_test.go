@@ -0,0 +1,103 @@
+package log
+
+import (
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	report, err := Check(dir)
+	require.NoError(t, err)
+	require.Empty(t, report.Issues)
+	require.Equal(t, LatestFormat, report.Format)
+	require.Equal(t, []SegmentReport{
+		{BaseOffset: 0, NextOffset: 3, StoreBytes: 85, IndexBytes: 36},
+		{BaseOffset: 3, NextOffset: 6, StoreBytes: 87, IndexBytes: 36},
+		{BaseOffset: 6, NextOffset: 6},
+	}, report.Segments)
+
+	var values []string
+	err = WalkRecords(dir, func(record *api.Record) error {
+		values = append(values, string(record.Value))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, values, 6)
+
+	// a torn write at the end of a store, a lost index and files that aren't segments
+	f, err := os.OpenFile(path.Join(dir, "3.store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "9.index"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "backup.store"), nil, 0644))
+
+	report, err = Check(dir)
+	require.NoError(t, err)
+	require.Equal(t, []Issue{
+		{File: "backup.store", Problem: "file is not part of a segment"},
+		{File: "0.index", Problem: "store file has no index file"},
+		{File: "3.store", Problem: "record of offset 6 at position 87 has a truncated header"},
+		{File: "9.index", Problem: "index file has no store file"},
+	}, report.Issues)
+
+	report, err = Repair(dir)
+	require.NoError(t, err)
+	require.Len(t, report.Issues, 4)
+	require.False(t, report.Issues[0].Repaired)
+	require.True(t, report.Issues[1].Repaired)
+
+	report, err = Check(dir)
+	require.NoError(t, err)
+	require.Len(t, report.Issues, 1)
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		read, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), read.Value)
+	}
+	require.NoError(t, l.Close())
+}
+
+func TestCheckIndex(t *testing.T) {
+	positions := []uint64{0, 20}
+	index := make([]byte, entWidth*4)
+	enc.PutUint32(index[entWidth:], 1)
+	enc.PutUint64(index[entWidth+offWidth:], 20)
+
+	require.Equal(t, "index has 24 bytes of unused space, the log wasn't closed cleanly",
+		checkIndex(index, positions, 0))
+	require.Equal(t, "", checkIndex(index[:entWidth*2], positions, 0))
+	require.Equal(t, "index is missing the entries of offsets 11 to 11", checkIndex(index[:entWidth], positions, 10))
+
+	enc.PutUint64(index[entWidth+offWidth:], 21)
+	require.Equal(t, "index entry of offset 1 points to position 21 instead of 20",
+		checkIndex(index[:entWidth*2], positions, 0))
+	require.Equal(t, "index entry of offset 0 points past the last valid record of the store",
+		checkIndex(index[:entWidth*2], nil, 0))
+}
@@ -19,10 +19,14 @@ var (
 // index defines our index file, which comprises a persisted file and a memory- mapped file.
 //
 // The size tells us the size of the index and where to write the next entry appended to the index.
+//
+// A read-only index maps the file as it is without growing it, since another process may
+// be writing to it, and only counts the entries that have been written so far.
 type index struct {
-	file *os.File
-	mmap gommap.MMap
-	size uint64
+	file     *os.File
+	mmap     gommap.MMap
+	size     uint64
+	readOnly bool
 }
 
 // newIndex creates an index for the given file. We create the index and save the current size
@@ -31,7 +35,11 @@ type index struct {
 // We grow the file to the max index size before memory-mapping the file and then return the
 // created index to the caller.
 func newIndex(f *os.File, c Config) (*index, error) {
-	idx := &index{file: f}
+	idx := &index{file: f, readOnly: c.ReadOnly}
+	if c.ReadOnly {
+		return idx, nil
+	}
+
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
@@ -54,6 +62,15 @@ func newIndex(f *os.File, c Config) (*index, error) {
 //
 // Then it truncates the persisted file to the amount of data that’s actually in it and closes the file.
 func (i *index) Close() error {
+	if i.readOnly {
+		if i.mmap != nil {
+			if err := i.mmap.UnsafeUnmap(); err != nil {
+				return err
+			}
+		}
+		return i.file.Close()
+	}
+
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
@@ -66,6 +83,14 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+// Sync flushes the entries written to the memory-mapped file to stable storage
+func (i *index) Sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
 // Write appends the given offset and position to the index
 func (i *index) Write(off uint32, pos uint64) error {
 	if uint64(len(i.mmap)) < i.size+entWidth {
@@ -102,6 +127,66 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Refresh counts the entries of a read-only index that were written since the last refresh,
+// remapping the file if the writer grew or shrank it. An entry is only counted if visible
+// returns true for it, which lets the segment skip entries whose record isn't in the store yet.
+//
+// The writer grows the file to its max size while it has it open, so the entries are the
+// ones following each other from the first, up to the zeroed space left at the end.
+func (i *index) Refresh(visible func(pos uint64) (bool, error)) error {
+	fi, err := i.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() != int64(len(i.mmap)) {
+		if i.mmap != nil {
+			if err = i.mmap.UnsafeUnmap(); err != nil {
+				return err
+			}
+			i.mmap = nil
+		}
+		if fi.Size() > 0 {
+			if i.mmap, err = gommap.Map(i.file.Fd(), gommap.PROT_READ, gommap.MAP_SHARED); err != nil {
+				return err
+			}
+		}
+	}
+	if i.size > uint64(len(i.mmap)) {
+		i.size = uint64(len(i.mmap)) / entWidth * entWidth
+	}
+
+	for i.size+entWidth <= uint64(len(i.mmap)) {
+		entry := i.size / entWidth
+		off := enc.Uint32(i.mmap[i.size : i.size+offWidth])
+		pos := enc.Uint64(i.mmap[i.size+offWidth : i.size+entWidth])
+		if uint64(off) != entry {
+			break
+		}
+		if entry > 0 && pos <= enc.Uint64(i.mmap[i.size-posWidth:i.size]) {
+			break
+		}
+		ok, err := visible(pos)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		i.size += entWidth
+	}
+
+	return nil
+}
+
+// Truncate drops every entry past the given number of entries. The dropped entries stay
+// in the memory-mapped file but are overwritten by the next writes.
+func (i *index) Truncate(entries uint64) {
+	if entries*entWidth < i.size {
+		i.size = entries * entWidth
+	}
+}
+
 // Name returns the index file's path
 func (i *index) Name() string {
 	return i.file.Name()
@@ -0,0 +1,64 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockFile is the name of the file locked by the process writing to a log directory
+const lockFile = "lock"
+
+// ErrDirLocked is returned when opening a log directory that another process has open
+var ErrDirLocked = errors.New("log directory is locked")
+
+// dirLock is an exclusive advisory lock on a log directory, preventing two processes from
+// writing to the same log. The lock is released by the OS if the process dies.
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir takes the lock of the given log directory, failing right away if another process
+// holds it. The PID of the holder is written to the lock file so the error can name it.
+func lockDir(dir string) (*dirLock, error) {
+	f, err := os.OpenFile(path.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, err
+		}
+		b, _ := ioutil.ReadFile(path.Join(dir, lockFile))
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			return nil, fmt.Errorf("%w: %s is in use by process %d", ErrDirLocked, dir, pid)
+		}
+		return nil, fmt.Errorf("%w: %s is in use by another process", ErrDirLocked, dir)
+	}
+
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &dirLock{file: f}, nil
+}
+
+// Unlock releases the lock. The lock file is left in place, since removing it could let
+// another process lock a file that's no longer in the directory.
+func (l *dirLock) Unlock() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,55 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(dir)
+
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	// a second writer fails fast, naming the process holding the directory
+	_, err = NewLog(dir, Config{})
+	require.True(t, errors.Is(err, ErrDirLocked))
+	require.True(t, strings.Contains(err.Error(), fmt.Sprintf("process %d", os.Getpid())))
+
+	_, err = Repair(dir)
+	require.True(t, errors.Is(err, ErrDirLocked))
+
+	// readers don't need the lock
+	c := Config{}
+	c.ReadOnly = true
+	reader, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	// closing the log releases the directory
+	require.NoError(t, l.Close())
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// and so does failing to open it, after some of its segments were opened
+	bad := path.Join(dir, "10.index")
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "10.store"), nil, 0644))
+	require.NoError(t, os.Mkdir(bad, 0755))
+	_, err = NewLog(dir, Config{})
+	require.Error(t, err)
+	require.NoError(t, os.Remove(bad))
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
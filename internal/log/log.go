@@ -1,6 +1,8 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	api "github.com/pandulaDW/go-distributed-service/api/v1"
 	"io"
 	"io/ioutil"
@@ -12,6 +14,9 @@ import (
 	"sync"
 )
 
+// ErrOpenedReadOnly is returned by the methods modifying a log that was opened read-only
+var ErrOpenedReadOnly = errors.New("log was opened read-only")
+
 // Log consists of a list of segments and a pointer to the active segment to append
 // writes to. The directory is where the segments are stored.
 type Log struct {
@@ -20,6 +25,9 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	readOnly      bool
+	lock          *dirLock
+	synced        uint64
 }
 
 // NewLog creates a returns a new log instance
@@ -30,24 +38,78 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Disk.MinFreeBytes == 0 {
+		c.Disk.MinFreeBytes = c.Segment.MaxStoreBytes + c.Segment.MaxIndexBytes
+	}
 
 	l := &Log{Dir: dir, Config: c}
 
-	return l, l.setup()
+	err := l.setup()
+	if err != nil {
+		// close the segments opened so far and release the directory, so the log can be opened
+		// again once the problem is fixed
+		_ = l.close()
+	}
+	return l, err
 }
 
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	// a read-only log doesn't modify the directory, so it can be opened while it's in use
+	if !l.Config.ReadOnly {
+		lock, err := lockDir(l.Dir)
+		if err != nil {
+			return err
+		}
+		l.lock = lock
+	}
+
+	baseOffsets, err := l.baseOffsets()
 	if err != nil {
 		return err
 	}
 
+	if err = l.setupFormat(len(baseOffsets) > 0); err != nil {
+		return err
+	}
+
+	for _, off := range baseOffsets {
+		if err = l.newSegment(off); err != nil {
+			return err
+		}
+	}
+
+	// create a new segment, if there aren't any existing segments
+	if l.segments == nil {
+		if l.Config.ReadOnly {
+			return fmt.Errorf("no log to open read-only in %s", l.Dir)
+		}
+		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// baseOffsets returns the base offsets of the segments in the log directory, oldest to newest
+func (l *Log) baseOffsets() ([]uint64, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+
 	var baseOffsets []uint64
 
-	// extract the available offsets
+	// extract the available offsets from the store files, skipping the manifest and other files
 	for _, file := range files {
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
 		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 
@@ -56,22 +118,36 @@ func (l *Log) setup() error {
 		return baseOffsets[i] < baseOffsets[j]
 	})
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
-		}
-		// baseOffset contains dup for index and store, so we skip the dup
-		i++
+	return baseOffsets, nil
+}
+
+// setupFormat resolves the on-disk format of the log from its manifest. Existing logs without
+// a manifest predate format versioning and are read as FormatV1, while new logs are created in
+// the configured format and get a manifest recording it.
+func (l *Log) setupFormat(existing bool) error {
+	m, ok, err := readManifest(l.Dir)
+	if err != nil {
+		return err
 	}
 
-	// create a new segment, if there aren't any existing segments
-	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
-			return err
-		}
+	switch {
+	case ok:
+		l.Config.Segment.FormatVersion = m.Version
+		return nil
+	case existing:
+		l.Config.Segment.FormatVersion = FormatV1
+		return nil
+	case l.Config.ReadOnly:
+		return nil
 	}
 
-	return nil
+	if l.Config.Segment.FormatVersion == 0 {
+		l.Config.Segment.FormatVersion = LatestFormat
+	}
+	if l.Config.Segment.FormatVersion > LatestFormat {
+		return fmt.Errorf("unsupported log format version %d", l.Config.Segment.FormatVersion)
+	}
+	return writeManifest(l.Dir, manifest{Version: l.Config.Segment.FormatVersion})
 }
 
 // newSegment creates a new segment, appends that segment to the log’s
@@ -83,6 +159,15 @@ func (l *Log) newSegment(off uint64) error {
 		return err
 	}
 
+	// the previous active segment is sealed now that appends move to the new one. A read-only
+	// log can't tell whether the writer flushed all of the segment yet, so it keeps reading it
+	if l.activeSegment != nil && l.Config.Segment.MmapSealedStores && !l.Config.ReadOnly {
+		if err = l.activeSegment.store.Seal(); err != nil {
+			_ = s.Close()
+			return err
+		}
+	}
+
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 	return nil
@@ -91,22 +176,226 @@ func (l *Log) newSegment(off uint64) error {
 // Append appends a record to the log. The record will be appended to the active segment.
 //
 // Afterward, if the segment is at its max size, then a new active segment will be created.
+//
+// When the disk runs out of space, the partial write is rolled back and the log switches
+// to read-only mode, rejecting appends with api.ErrLogReadOnly until enough space is freed.
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.Config.ReadOnly {
+		return 0, ErrOpenedReadOnly
+	}
+	if l.readOnly && !l.leaveReadOnly() {
+		return 0, api.ErrLogReadOnly{Dir: l.Dir}
+	}
+
+	first := l.activeSegment.nextOffset
+	off, err := l.append(record)
+	if err == nil {
+		err = l.flush(first)
+	}
+	if err != nil {
+		return 0, l.rollback(first, err)
+	}
+	return off, nil
+}
+
+// AppendBatch appends the records to the log in order, returning the offset of the first one.
+// The batch is appended as a whole: when a record fails to append, the records of the batch
+// appended before it are removed.
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Config.ReadOnly {
+		return 0, ErrOpenedReadOnly
+	}
+	if l.readOnly && !l.leaveReadOnly() {
+		return 0, api.ErrLogReadOnly{Dir: l.Dir}
+	}
+
+	first := l.activeSegment.nextOffset
+	for _, record := range records {
+		if _, err := l.append(record); err != nil {
+			return 0, l.rollback(first, err)
+		}
+	}
+	if err := l.flush(first); err != nil {
+		return 0, l.rollback(first, err)
+	}
+	return first, nil
+}
+
+// flush writes the records appended from the given offset on, which the stores' buffered
+// writers may still hold, to the segments' files. Each call appending to the log flushes
+// its records once it appended all of them, rather than after each one.
+func (l *Log) flush(first uint64) error {
+	for _, s := range l.segments {
+		if s.nextOffset <= first && s != l.activeSegment {
+			continue
+		}
+		if err := s.store.Flush(); err != nil {
+			return l.checkOutOfSpace(err)
+		}
+	}
+	return nil
+}
+
+// rollback removes the records appended from the given offset on by a call that failed with
+// err, so that the call fails as a whole. The records the stores' buffered writers still hold
+// are dropped, and the ones that reached the files are truncated. The records before them were
+// flushed by the previous calls, so they keep their offsets.
+func (l *Log) rollback(first uint64, err error) error {
+	for _, s := range l.segments {
+		if s.nextOffset > first || s == l.activeSegment {
+			s.store.Discard()
+		}
+	}
+	if rollbackErr := l.truncateFrom(first); rollbackErr != nil {
+		return fmt.Errorf("%w, and rolling back the appended records failed: %s", err, rollbackErr)
+	}
+	return err
+}
+
+// append appends a record to the active segment, rolling the segment when it's maxed
+func (l *Log) append(record *api.Record) (uint64, error) {
+	// the previous append may have maxed the segment without being able to roll it
+	if l.activeSegment.IsMaxed() {
+		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return 0, l.checkOutOfSpace(err)
+		}
+	}
+
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
-		return 0, err
+		return 0, l.checkOutOfSpace(err)
 	}
 
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+		if err = l.newSegment(off + 1); isOutOfSpace(err) {
+			// the record itself is safely stored, only the next one has nowhere to go
+			l.readOnly = true
+			err = nil
+		}
 	}
 
 	return off, err
 }
 
+// Sync flushes the records appended since the last sync to stable storage. The appended
+// records reach the log's files right away, so they survive the process crashing, but they
+// only survive the machine crashing once synced.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Config.ReadOnly {
+		return ErrOpenedReadOnly
+	}
+	for _, s := range l.segments {
+		if s.nextOffset <= l.synced {
+			continue
+		}
+		if err := s.Sync(); err != nil {
+			return l.checkDiskFailure(err)
+		}
+	}
+	l.synced = l.activeSegment.nextOffset
+	return nil
+}
+
+// checkOutOfSpace switches the log to read-only mode if err was caused by the disk running
+// out of space, translating it to api.ErrLogReadOnly. Other errors are returned as is.
+func (l *Log) checkOutOfSpace(err error) error {
+	if !isOutOfSpace(err) {
+		return l.checkDiskFailure(err)
+	}
+	l.readOnly = true
+	return api.ErrLogReadOnly{Dir: l.Dir}
+}
+
+// checkDiskFailure reports err to Config.Disk.OnFailure if it was caused by a failing disk,
+// and returns it as is
+func (l *Log) checkDiskFailure(err error) error {
+	if err != nil && isDiskFailure(err) && l.Config.Disk.OnFailure != nil {
+		l.Config.Disk.OnFailure(err)
+	}
+	return err
+}
+
+// leaveReadOnly switches the log back to read-write mode if its filesystem has at least
+// Config.Disk.MinFreeBytes available and reports whether the log is writable again.
+func (l *Log) leaveReadOnly() bool {
+	free, _, err := diskSpace(l.Dir)
+	if err != nil || free < l.Config.Disk.MinFreeBytes {
+		return false
+	}
+	l.readOnly = false
+	return true
+}
+
+// ReadOnly reports whether the log is only serving reads, either because it was opened
+// read-only or because it has run out of disk space.
+func (l *Log) ReadOnly() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.readOnly || l.Config.ReadOnly
+}
+
+// Refresh picks up the changes the process writing to a read-only log made since it was
+// opened or last refreshed: the records it appended and flushed, the segments it created
+// and the ones that retention removed.
+func (l *Log) Refresh() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.Config.ReadOnly {
+		return fmt.Errorf("only a read-only log can be refreshed")
+	}
+
+	baseOffsets, err := l.baseOffsets()
+	if err != nil {
+		return err
+	}
+	present := make(map[uint64]bool, len(baseOffsets))
+	for _, off := range baseOffsets {
+		present[off] = true
+	}
+
+	// the segments removed from the directory stay readable until closed, so they're dropped
+	var segments []*segment
+	for _, s := range l.segments {
+		if !present[s.baseOffset] && s != l.activeSegment {
+			if err = s.Close(); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+
+	// the writer may still have been flushing the records of segments it has since rolled over
+	for i, s := range l.segments {
+		if i < len(l.segments)-1 && s.nextOffset == l.segments[i+1].baseOffset {
+			continue
+		}
+		if err = s.refresh(); err != nil {
+			return err
+		}
+	}
+
+	for _, off := range baseOffsets {
+		if off > l.activeSegment.baseOffset {
+			if err = l.newSegment(off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Read reads the record stored at the given offset.
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
@@ -124,25 +413,41 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
 
-	return s.Read(off)
+	record, err := s.Read(off)
+	return record, l.checkDiskFailure(err)
 }
 
-// Close iterates over the segments and closes them.
+// Close iterates over the segments and closes them, then releases the log directory. The
+// directory is released even when a segment fails to close, and the first error is returned.
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.close()
+}
 
+func (l *Log) close() error {
+	var err error
 	for _, s := range l.segments {
-		if err := s.Close(); err != nil {
-			return err
+		if closeErr := s.Close(); closeErr != nil && err == nil {
+			err = closeErr
 		}
 	}
 
-	return nil
+	if l.lock != nil {
+		if unlockErr := l.lock.Unlock(); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+		l.lock = nil
+	}
+
+	return err
 }
 
 // Remove closes the log and then removes its data
 func (l *Log) Remove() error {
+	if l.Config.ReadOnly {
+		return ErrOpenedReadOnly
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
@@ -154,6 +459,10 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment = nil, nil
 	return l.setup()
 }
 
@@ -176,17 +485,31 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// HighWatermark returns the offset following the highest record of the log, which the
+// next appended record gets. Unlike HighestOffset, it tells an empty log apart.
+func (l *Log) HighWatermark() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
 // Truncate removes all segments whose highest offset is lower than lowest.
-// This is to remove older logs to save disk space.
+// This is to remove older logs to save disk space, so a read-only log becomes
+// writable again once the removal frees enough of it.
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
-	l.mu.Unlock()
+	defer l.mu.Unlock()
+
+	if l.Config.ReadOnly {
+		return ErrOpenedReadOnly
+	}
 
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
-				return err
+		// the active segment is kept, so the log always has a segment to append to
+		if s != l.activeSegment && s.nextOffset <= lowest+1 {
+			if err := s.release(); err != nil {
+				return l.checkDiskFailure(err)
 			}
 			continue
 		}
@@ -194,9 +517,50 @@ func (l *Log) Truncate(lowest uint64) error {
 	}
 
 	l.segments = segments
+	if l.readOnly {
+		l.leaveReadOnly()
+	}
 	return nil
 }
 
+// TruncateFrom removes every record from the given offset on, so that the next appended
+// record gets that offset. Unlike Truncate, which removes old records, it's used to discard
+// records that turned out to conflict with the rest of a replicated log.
+func (l *Log) TruncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Config.ReadOnly {
+		return ErrOpenedReadOnly
+	}
+	return l.truncateFrom(off)
+}
+
+func (l *Log) truncateFrom(off uint64) error {
+	if off < l.segments[0].baseOffset {
+		return fmt.Errorf("can't truncate from offset %d, before the log starts", off)
+	}
+
+	// the first segment is kept, so the log always has a segment to append to
+	var segments []*segment
+	for i, s := range l.segments {
+		if i > 0 && s.baseOffset >= off {
+			if err := s.release(); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	l.activeSegment = segments[len(segments)-1]
+	if l.synced > off {
+		l.synced = off
+	}
+
+	return l.activeSegment.truncate(off)
+}
+
 // Reader returns an io.Reader to read the whole log.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
@@ -1,22 +1,27 @@
 package log
 
 import (
+	"bufio"
 	"fmt"
 	api "github.com/pandulaDW/go-distributed-service/api/v1"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
 	"io/ioutil"
 	"os"
+	"syscall"
 	"testing"
 )
 
 func TestLog(t *testing.T) {
 	for scenario, fn := range map[string]func(t *testing.T, log *Log){
-		"append and read a record succeeds": testAppendRead,
-		"offset out of range error":         testOutOfRangeErr,
-		"initialize with existing segments": testInitExisting,
-		"reader":                            testReader,
-		"truncate":                          testTruncate,
+		"append and read a record succeeds":  testAppendRead,
+		"append a batch of records":          testAppendBatch,
+		"offset out of range error":          testOutOfRangeErr,
+		"initialize with existing segments":  testInitExisting,
+		"reader":                             testReader,
+		"truncate":                           testTruncate,
+		"out of space switches to read-only": testOutOfSpace,
+		"reads sealed stores from mmap":      testMmapSealedStores,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -46,6 +51,38 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.Equal(t, record.Value, read.Value)
 }
 
+func testAppendBatch(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	// the batch spans several segments
+	batch := []*api.Record{
+		{Value: []byte("hello world"), Origin: "peer", OriginOffset: 7},
+		{Value: []byte("hello world"), Origin: "peer", OriginOffset: 8},
+		{Value: []byte("hello world"), Origin: "peer", OriginOffset: 9},
+	}
+	off, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, uint64(4), log.HighWatermark())
+
+	for i := range batch {
+		read, err := log.Read(off + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, off+uint64(i), read.Offset)
+		require.Equal(t, uint64(7+i), read.OriginOffset)
+	}
+
+	// a batch failing to reach the disk is removed as a whole, the records flushed before too
+	s := log.activeSegment.store
+	s.buf = bufio.NewWriter(&fullDisk{File: s.File, left: 20})
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("a")}, {Value: []byte("b")}})
+	require.Equal(t, api.ErrLogReadOnly{Dir: log.Dir}, err)
+	require.Equal(t, uint64(4), log.HighWatermark())
+	_, err = os.Stat(s.Name())
+	require.True(t, os.IsNotExist(err))
+}
+
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
@@ -93,7 +130,7 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[lenWidth+crcWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, record.Value, read.Value)
 }
@@ -115,3 +152,161 @@ func testTruncate(t *testing.T, log *Log) {
 	require.NoError(t, err)
 	require.Equal(t, []byte("hello world 2"), read.Value)
 }
+
+func testOutOfSpace(t *testing.T, log *Log) {
+	defer func(fn func(string) (uint64, uint64, error)) {
+		diskSpace = fn
+	}(diskSpace)
+	free := uint64(0)
+	diskSpace = func(string) (uint64, uint64, error) {
+		return free, free, nil
+	}
+
+	record := &api.Record{Value: []byte("hello")}
+	_, err := log.Append(record)
+	require.NoError(t, err)
+
+	// fail the flush half-way through the second record
+	s := log.activeSegment.store
+	s.buf = bufio.NewWriterSize(&fullDisk{File: s.File, left: lenWidth}, 16)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world, this won't fit")})
+	require.Equal(t, api.ErrLogReadOnly{Dir: log.Dir}, err)
+	require.True(t, log.ReadOnly())
+
+	// the partial write was rolled back and reads are still served
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), highest)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, read.Value)
+	info, err := os.Stat(s.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(s.size), info.Size())
+
+	_, err = log.Append(record)
+	require.Equal(t, api.ErrLogReadOnly{Dir: log.Dir}, err)
+
+	// freeing space brings the log back to read-write mode
+	free = log.Config.Disk.MinFreeBytes
+	require.NoError(t, log.Truncate(0))
+	require.False(t, log.ReadOnly())
+
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+// fullDisk is a writer that fails with ENOSPC once it has written left bytes
+type fullDisk struct {
+	*os.File
+	left int
+}
+
+func (f *fullDisk) Write(p []byte) (int, error) {
+	if len(p) <= f.left {
+		f.left -= len(p)
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:f.left])
+	f.left = 0
+	return n, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+}
+
+func testMmapSealedStores(t *testing.T, log *Log) {
+	log.Config.Segment.MmapSealedStores = true
+	for i := 0; i < 4; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+
+	// two records fit in each segment
+	require.Len(t, log.segments, 3)
+	for _, s := range log.segments[:2] {
+		require.NotNil(t, s.store.mmap)
+	}
+	require.Nil(t, log.activeSegment.store.mmap)
+
+	for i := 0; i < 4; i++ {
+		read, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), read.Value)
+	}
+	require.NoError(t, log.Close())
+}
+
+func TestReadOnlyLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "read-only-test")
+	require.NoError(t, err)
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	writer, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() {
+		_ = writer.Close()
+	}()
+
+	appendFlushed := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := writer.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+		// the records are only visible to readers once flushed to the store
+		for _, s := range writer.segments {
+			require.NoError(t, s.store.buf.Flush())
+		}
+	}
+	appendFlushed(2)
+
+	c.ReadOnly = true
+	reader, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.True(t, reader.ReadOnly())
+
+	highest, err := reader.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), highest)
+	_, err = reader.Read(2)
+	require.Error(t, err)
+
+	_, err = reader.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrOpenedReadOnly, err)
+	require.Equal(t, ErrOpenedReadOnly, reader.Truncate(0))
+
+	// refreshing picks up new records and segments
+	appendFlushed(5)
+	require.NoError(t, reader.Refresh())
+	highest, err = reader.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), highest)
+	for i := uint64(0); i <= highest; i++ {
+		read, err := reader.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+
+	// and drops the segments removed by retention
+	require.NoError(t, writer.Truncate(3))
+	require.NoError(t, reader.Refresh())
+	lowest, err := reader.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+
+	// closing the reader leaves the writer's files as they were
+	info, err := os.Stat(writer.activeSegment.index.Name())
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	after, err := os.Stat(writer.activeSegment.index.Name())
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), after.Size())
+	require.Equal(t, int64(writer.Config.Segment.MaxIndexBytes), after.Size())
+
+	_, err = writer.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+}
@@ -3,28 +3,258 @@ package log
 import (
 	"context"
 	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
+)
+
+var (
+	// peerKey tags the replication metrics with the name of the replicated peer
+	peerKey = tag.MustNewKey("peer")
+
+	lagRecords = stats.Int64("replication/lag_records",
+		"Number of records of the peer's log not replicated yet", stats.UnitDimensionless)
+	lagSeconds = stats.Float64("replication/lag_seconds",
+		"Time since the replica was last caught up with the peer's log", stats.UnitSeconds)
+
+	divergentRanges = stats.Int64("replication/divergent_ranges",
+		"Number of ranges holding different records on the replica and the peer", stats.UnitDimensionless)
+
+	throttledSeconds = stats.Float64("replication/throttled_seconds",
+		"Time the replication of the peer was delayed by the rate limits", stats.UnitSeconds)
+
+	// ReplicationViews are the views of the replication lag, verification and throttling
+	// metrics, by peer
+	ReplicationViews = []*view.View{
+		{
+			Name:        lagRecords.Name(),
+			Description: lagRecords.Description(),
+			Measure:     lagRecords,
+			TagKeys:     []tag.Key{peerKey},
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        lagSeconds.Name(),
+			Description: lagSeconds.Description(),
+			Measure:     lagSeconds,
+			TagKeys:     []tag.Key{peerKey},
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        divergentRanges.Name(),
+			Description: divergentRanges.Description(),
+			Measure:     divergentRanges,
+			TagKeys:     []tag.Key{peerKey},
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        throttledSeconds.Name(),
+			Description: throttledSeconds.Description(),
+			Measure:     throttledSeconds,
+			TagKeys:     []tag.Key{peerKey},
+			Aggregation: view.Sum(),
+		},
+	}
 )
 
 // Replicator connects to other servers with the gRPC client.
 //
 // clientOptions field is used to configure the client to authenticate with the servers.
 //
-// the server field is a map of server addresses to a channel, which the replicator
-// uses to stop replicating from a server when the server fails or leaves the cluster
+// the server field is a map of server names to the worker replicating the server, which
+// the replicator stops when the server fails or leaves the cluster. A worker whose
+// connection fails reconnects after a jittered exponential backoff, growing from
+// InitialBackoff up to MaxBackoff, and resuming from its checkpoint.
+//
+// The replicator fetches batches of records from the other servers, of up to BatchRecords
+// records and BatchBytes bytes, and appends a copy of each batch to LocalLog. With
+// Checkpoints set, it records how far it copied each server's log and resumes from there,
+// otherwise it copies the logs from their start. The servers' defaults apply to the batch
+// limits left unset. The checkpoints are flushed every CheckpointInterval, after syncing
+// LocalLog, rather than after each batch.
+//
+// With Bootstrap set, a replicator whose local log is still empty imports the sealed segments
+// of the first server it connects to as they are on disk, instead of copying their records one
+// by one, and then fetches the records following them. It falls back to fetching every record
+// when the server can't ship its segments.
+//
+// Copied records carry the name of the node they were produced to and their offset there,
+// so records of NodeName and records already copied through another server are skipped,
+// rather than being copied back and forth between the servers.
+//
+// RateLimit and PeerRateLimit limit the bytes copied per second, in total and from each server,
+// so that a replicator catching up doesn't saturate the network. They're unlimited while 0, and
+// replaced at runtime with SetThrottle.
+//
+// An Observer replicator copies the logs for a read-only server, and tells the servers so that
+// it isn't counted among their replicas acknowledging records. The observers hold no records of
+// their own, so the replicators don't copy the logs of the observers joining.
 //
-// The replicator calls the produce function to save a copy of the messages it consumes
-// from the other servers
+// With Assigned set, only the records of the origins it reports the local log holds replicas
+// of are copied, the others are skipped. The skipped records don't move the checkpoint of their
+// origin, and the replicator fetches from the servers whose records it skips as an observer, so
+// that they don't count it among the replicas acknowledging their records. The placement changes
+// as servers join and fail, so Assigned is asked again before each fetch, and a replicator newly
+// assigned a server's records catches up with them: it fetches the server's log again from the
+// first of its records not copied yet, and only copies the server's records from the server
+// itself until it's caught up, rather than copying the ones relayed by the others past the ones
+// it skipped.
+//
+// With Verify set, the replicator also compares the digests of the local log with the ones of
+// each server every VerifyInterval, reporting the divergent ranges in the server's status, and
+// repairs the ranges the RepairFrom server holds more records of. See verify.
 type Replicator struct {
-	DialOptions []grpc.DialOption
-	LocalServer api.LogClient
-	logger      *zap.Logger
-	mu          sync.Mutex
-	servers     map[string]chan struct{}
-	closed      bool
-	close       chan struct{}
+	DialOptions        []grpc.DialOption
+	LocalLog           BatchAppender
+	Bootstrap          SegmentImporter
+	Verify             DigestLog
+	BatchRecords       int
+	BatchBytes         int
+	Checkpoints        *Checkpoints
+	CheckpointInterval time.Duration
+	NodeName           string
+	InitialBackoff     time.Duration
+	MaxBackoff         time.Duration
+	VerifyInterval     time.Duration
+	DigestRangeSize    uint64
+	RepairFrom         string
+	Assigned           func(origin string) bool
+	Observer           bool
+	RateLimit          uint64
+	PeerRateLimit      uint64
+	logger             *zap.Logger
+	mu                 sync.Mutex
+	copyMu             sync.Mutex
+	servers            map[string]*worker
+	catchingUp         map[string]bool
+	workers            sync.WaitGroup
+	closed             bool
+	close              chan struct{}
+	limit              *throttle
+}
+
+// BatchAppender appends batches of records to a log and syncs them to stable storage, such
+// as Log
+type BatchAppender interface {
+	AppendBatch([]*api.Record) (uint64, error)
+	HighWatermark() uint64
+	Sync() error
+}
+
+// SegmentImporter imports the segments shipped from another log, such as Log.ImportSegment
+type SegmentImporter interface {
+	ImportSegment(baseOffset uint64, formatVersion uint32) (*SegmentImport, error)
+	HighWatermark() uint64
+	Read(uint64) (*api.Record, error)
+}
+
+// fetchWait is how long the servers hold the fetch requests of the replicator when they
+// have no records past the requested offset yet
+const fetchWait = 500 * time.Millisecond
+
+// WorkerState is the state of the worker replicating a server
+type WorkerState string
+
+const (
+	// WorkerConnecting is the state of a worker opening a stream to the server
+	WorkerConnecting WorkerState = "connecting"
+	// WorkerBootstrapping is the state of a worker importing the sealed segments of the server
+	WorkerBootstrapping WorkerState = "bootstrapping"
+	// WorkerReplicating is the state of a worker copying the records of the server
+	WorkerReplicating WorkerState = "replicating"
+	// WorkerBackingOff is the state of a worker waiting to reconnect after a failure
+	WorkerBackingOff WorkerState = "backing-off"
+)
+
+// PeerStatus reports how the replication of a server is going. Failures counts the
+// attempts that failed in a row, and LastError is the error of the latest one.
+//
+// LastOffset is the offset of the last record of the server's log the worker went past,
+// whether it copied or skipped it, and HighWatermark the offset following the highest
+// record of the server's log when the worker last heard from it. Lag is the number of
+// records in between, and LagTime how long ago the worker was last caught up.
+//
+// Divergent are the ranges whose records differed between the local log and the server's
+// when their digests were compared at Verified. Throttled is how long the rate limits delayed
+// the replication of the server in total.
+type PeerStatus struct {
+	Addr          string
+	State         WorkerState
+	LastOffset    uint64
+	HighWatermark uint64
+	Lag           uint64
+	LagTime       time.Duration
+	Failures      int
+	LastError     error
+	Divergent     []*api.DivergentRange
+	Verified      time.Time
+	Throttled     time.Duration
+}
+
+// worker replicates a server until its context is cancelled
+type worker struct {
+	name   string
+	addr   string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	status   PeerStatus
+	caughtUp time.Time
+	limit    *throttle
+
+	// assigned is whether the local log held replicas of the server's records at the previous
+	// fetch. It's only used by the worker's goroutine.
+	assigned bool
+}
+
+func (w *worker) setState(state WorkerState) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.State = state
+}
+
+// setProgress records that the worker went past the record at the offset, so its earlier
+// failures are over, and returns the resulting lag
+func (w *worker) setProgress(offset, highWatermark uint64) (uint64, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.status.Failures = 0
+	w.status.LastOffset = offset
+	w.status.HighWatermark = highWatermark
+	w.status.Lag = 0
+	if highWatermark > offset+1 {
+		w.status.Lag = highWatermark - offset - 1
+	}
+	if w.status.Lag == 0 {
+		w.caughtUp = time.Now()
+	}
+	return w.status.Lag, w.lagTime()
+}
+
+// lagTime returns how long ago the worker was last caught up
+func (w *worker) lagTime() time.Duration {
+	if w.status.Lag == 0 {
+		return 0
+	}
+	return time.Since(w.caughtUp)
+}
+
+func (w *worker) setFailed(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.State = WorkerBackingOff
+	w.status.Failures++
+	w.status.LastError = err
 }
 
 // init is a helper function to initialize few values
@@ -33,23 +263,85 @@ func (r *Replicator) init() {
 		r.logger = zap.L().Named("replicator")
 	}
 	if r.servers == nil {
-		r.servers = make(map[string]chan struct{})
+		r.servers = make(map[string]*worker)
+		r.catchingUp = make(map[string]bool)
+	}
+	if r.CheckpointInterval == 0 {
+		r.CheckpointInterval = time.Second
+	}
+	if r.Checkpoints == nil {
+		r.Checkpoints = newMemoryCheckpoints()
+	}
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 10 * time.Second
+	}
+	if r.VerifyInterval == 0 {
+		r.VerifyInterval = time.Minute
+	}
+	if r.DigestRangeSize == 0 {
+		r.DigestRangeSize = 1024
+	}
+	if r.limit == nil {
+		r.limit = newThrottle(r.RateLimit)
 	}
 	if r.close == nil {
 		r.close = make(chan struct{})
+		r.workers.Add(1)
+		go r.flushCheckpoints()
 	}
 }
 
-// replicate creates a client connection that consumes all logs on the server
-// using a streaming client request.
+// run supervises the replication of a server, reconnecting after each failure until
+// the server leaves or the replicator closes.
+func (r *Replicator) run(w *worker) {
+	defer r.workers.Done()
+
+	backoff := r.InitialBackoff
+	for {
+		connected, err := r.replicate(w)
+		if w.ctx.Err() != nil {
+			return
+		}
+		// a worker that fetched from the server was connected, so it starts backing off anew
+		if connected {
+			backoff = r.InitialBackoff
+		}
+		w.setFailed(err)
+		r.logError(err, "replication failed, reconnecting", w.addr)
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(jitter(backoff)):
+		}
+
+		if backoff *= 2; backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
+
+// jitter returns a random duration between half of the backoff and the full backoff, so
+// that the workers that failed together don't all reconnect at the same time
+func jitter(backoff time.Duration) time.Duration {
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// replicate creates a client connection that fetches the logs on the server from the
+// worker's checkpoint, batch after batch, and appends a copy of each batch to the local log.
+// It returns when a fetch fails or the worker is stopped, reporting whether it connected.
 //
-// the client also runs a loop which consumes the logs from the discovered server in a stream
-// and then produces to the local server to save a copy
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
-	clientConn, err := grpc.Dial(addr, r.DialOptions...)
+// Fetching from an offset acknowledges the previous batches to the server, so that its
+// produce requests waiting for their record to be replicated can complete.
+func (r *Replicator) replicate(w *worker) (bool, error) {
+	w.setState(WorkerConnecting)
+	clientConn, err := grpc.Dial(w.addr, r.DialOptions...)
 	if err != nil {
-		r.logError(err, "failed to dial ", addr)
-		return
+		return false, err
 	}
 	defer func(clientConn *grpc.ClientConn) {
 		_ = clientConn.Close()
@@ -57,94 +349,420 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 
 	client := api.NewLogClient(clientConn)
 
-	ctx := context.Background()
-	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	if r.Bootstrap != nil {
+		if err = r.bootstrap(w, client); err != nil {
+			if w.ctx.Err() != nil {
+				return false, err
+			}
+			r.logError(err, "bootstrapping from the server's segments failed, fetching its records instead", w.addr)
+		}
+	}
+
+	connected := false
+	for {
+		assigned := r.assigned(w.name)
+		if assigned && !w.assigned && r.Assigned != nil {
+			r.catchUp(w.name)
+		}
+		w.assigned = assigned
+
+		res, err := client.Fetch(w.ctx, &api.FetchRequest{
+			Offset:     r.Checkpoints.Offset(w.name),
+			Replica:    r.NodeName,
+			Observer:   r.Observer || !assigned,
+			MaxRecords: uint32(r.BatchRecords),
+			MaxBytes:   uint32(r.BatchBytes),
+			MaxWaitMs:  uint32(fetchWait / time.Millisecond),
+		})
+		if err != nil {
+			return connected, err
+		}
+		if !connected {
+			connected = true
+			w.setState(WorkerReplicating)
+		}
+		if len(res.Records) == 0 {
+			r.caughtUpWith(w.name)
+			continue
+		}
+
+		last := res.Records[len(res.Records)-1].Offset
+		if err = r.copy(w.name, res.Records); err != nil {
+			return connected, err
+		}
+		if last+1 >= res.HighWatermark {
+			r.caughtUpWith(w.name)
+		}
+		r.recordLag(w, last, res.HighWatermark)
+
+		size := 0
+		for _, record := range res.Records {
+			size += proto.Size(record)
+		}
+		if err = r.throttle(w, size); err != nil {
+			return connected, err
+		}
+	}
+}
+
+// bootstrap imports the sealed segments of the server into the local log, when it's still empty,
+// moving the worker's checkpoint past each imported segment.
+//
+// The records of the other servers keep being copied while the segments are streamed, and are
+// only held off while each segment is committed. A segment can't be committed once records
+// were copied to the local log, in which case the worker fetches the rest of the server's log.
+func (r *Replicator) bootstrap(w *worker, client api.LogClient) error {
+	if r.Checkpoints.Offset(w.name) != 0 || r.Bootstrap.HighWatermark() != 0 {
+		return nil
+	}
+
+	stream, err := client.FetchSegments(w.ctx, &api.FetchSegmentsRequest{})
 	if err != nil {
-		r.logError(err, "failed to consume", addr)
-		return
+		return err
 	}
+	w.setState(WorkerBootstrapping)
 
-	records := make(chan *api.Record)
+	var segment *SegmentImport
+	defer func() {
+		if segment != nil {
+			_ = segment.Abort()
+		}
+	}()
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-	go func() {
-		for {
-			received, err := stream.Recv()
-			if err != nil {
-				r.logError(err, "failed to receive", addr)
-				return
+		if segment == nil {
+			if segment, err = r.Bootstrap.ImportSegment(chunk.BaseOffset, chunk.FormatVersion); err != nil {
+				return err
 			}
-			records <- received.Record
 		}
-	}()
+		if err = segment.Write(chunk.File, chunk.Data); err != nil {
+			return err
+		}
+		if err = r.throttle(w, len(chunk.Data)); err != nil {
+			return err
+		}
+		if !chunk.Last {
+			continue
+		}
+
+		err = r.commitImport(w.name, segment, chunk)
+		segment = nil
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// commitImport commits the segment imported from the peer, and checkpoints its records
+func (r *Replicator) commitImport(peer string, segment *SegmentImport, last *api.SegmentChunk) error {
+	r.copyMu.Lock()
+	defer r.copyMu.Unlock()
+
+	if err := segment.Commit(last.NextOffset, last.Checksum); err != nil {
+		return err
+	}
+	return r.checkpointImport(peer, last.BaseOffset, last.NextOffset)
+}
+
+// checkpointImport moves the peer's checkpoint past the records of a segment imported from it,
+// and the checkpoints of their origins past them too, so that they aren't copied again.
+func (r *Replicator) checkpointImport(peer string, baseOffset, nextOffset uint64) error {
+	origins := make(map[string]uint64)
+	for off := baseOffset; off < nextOffset; off++ {
+		record, err := r.Bootstrap.Read(off)
+		if err != nil {
+			return err
+		}
+		// the records of logs without an origin were produced to the peer itself
+		if record.Origin == "" {
+			origins[peer] = record.Offset + 1
+			continue
+		}
+		origins[record.Origin] = record.OriginOffset + 1
+	}
+	r.Checkpoints.Set(peer, nextOffset, origins)
+	return nil
+}
+
+// recordLag updates the worker's status and the lag metrics after it went past a record
+func (r *Replicator) recordLag(w *worker, offset, highWatermark uint64) {
+	lag, lagTime := w.setProgress(offset, highWatermark)
+	ctx, err := tag.New(context.Background(), tag.Upsert(peerKey, w.name))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, lagRecords.M(int64(lag)), lagSeconds.M(lagTime.Seconds()))
+}
+
+// copy appends the records fetched from the peer to the local log, except the ones produced
+// to this node, already copied, or of origins the local log isn't assigned or is catching up
+// with from the origin itself, and moves the peer's checkpoint past them.
+//
+// The checkpoints only reach the disk once the local log is synced, by flush, so that a crash
+// following the append never leaves them past a batch the log lost.
+func (r *Replicator) copy(peer string, records []*api.Record) error {
+	next := records[len(records)-1].Offset + 1
+
+	// serializes the copies, so two peers can't both copy the same record
+	r.copyMu.Lock()
+	defer r.copyMu.Unlock()
+
+	var batch []*api.Record
+	origins := make(map[string]uint64)
+	assigned := make(map[string]bool)
+	for _, record := range records {
+		if record.Origin == "" {
+			// the record was produced to the peer itself
+			record.Origin, record.OriginOffset = peer, record.Offset
+		}
+
+		originNext, ok := origins[record.Origin]
+		if !ok {
+			originNext = r.Checkpoints.OriginOffset(record.Origin)
+		}
+		if record.Origin == r.NodeName || record.OriginOffset < originNext {
+			continue
+		}
+		if r.catchingUp[record.Origin] && record.Origin != peer {
+			continue
+		}
+		ok, asked := assigned[record.Origin]
+		if !asked {
+			ok = r.assigned(record.Origin)
+			assigned[record.Origin] = ok
+		}
+		if !ok {
+			continue
+		}
+		batch = append(batch, record)
+		origins[record.Origin] = record.OriginOffset + 1
+	}
+
+	if len(batch) > 0 {
+		if _, err := r.LocalLog.AppendBatch(batch); err != nil {
+			return err
+		}
+	}
+	r.Checkpoints.Set(peer, next, origins)
+	return nil
+}
+
+// assigned reports whether the local log holds a replica of the origin's records
+func (r *Replicator) assigned(origin string) bool {
+	return r.Assigned == nil || r.Assigned(origin)
+}
+
+// catchUp has the local log catch up with the records of the peer it was newly assigned. The
+// peer's records it skipped didn't move their origin's checkpoint, so the peer's log is fetched
+// again from the first of them, the peer's own records being at their origin offsets in its log.
+// Until it's caught up, the peer's records relayed by the others aren't copied, since they would
+// move the checkpoint past the skipped ones.
+func (r *Replicator) catchUp(peer string) {
+	r.copyMu.Lock()
+	defer r.copyMu.Unlock()
+
+	if next := r.Checkpoints.OriginOffset(peer); next < r.Checkpoints.Offset(peer) {
+		r.Checkpoints.Set(peer, next, nil)
+	}
+	r.catchingUp[peer] = true
+}
+
+// caughtUpWith records that the local log holds the peer's records up to its high watermark
+func (r *Replicator) caughtUpWith(peer string) {
+	r.copyMu.Lock()
+	defer r.copyMu.Unlock()
+	delete(r.catchingUp, peer)
+}
 
+// flushCheckpoints flushes the checkpoints every CheckpointInterval, and a last time once the
+// replicator closes
+func (r *Replicator) flushCheckpoints() {
+	defer r.workers.Done()
+
+	ticker := time.NewTicker(r.CheckpointInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-r.close:
+			if err := r.flush(); err != nil {
+				r.logger.Error("flushing the replication checkpoints failed", zap.Error(err))
+			}
 			return
-		case <-leave:
-			return
-		case record := <-records:
-			_, err = r.LocalServer.Produce(ctx, &api.ProduceRequest{Record: record})
-			if err != nil {
-				r.logError(err, "failed to produce", addr)
-				return
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				r.logger.Error("flushing the replication checkpoints failed", zap.Error(err))
 			}
 		}
 	}
 }
 
+// flush syncs the local log and then writes the checkpoints of the records copied to it
+func (r *Replicator) flush() error {
+	// the copies are held off, so the checkpoints account for the records up to the high watermark
+	r.copyMu.Lock()
+	defer r.copyMu.Unlock()
+	return r.Checkpoints.Flush(r.LocalLog.HighWatermark(), r.LocalLog.Sync)
+}
+
 // Leave method handles the server leaving the cluster by removing the server from
-// the list of servers to replicate and closes the server’s associated channel
+// the list of servers to replicate and stopping the server's worker
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	r.init()
-	if _, ok := r.servers[name]; !ok {
-		return nil
+	r.leave(name)
+	return nil
+}
+
+func (r *Replicator) leave(name string) {
+	w, ok := r.servers[name]
+	if !ok {
+		return
 	}
 
-	close(r.servers[name])
+	w.cancel()
 	delete(r.servers, name)
+	// the peer's records are relayed by the others from now on
+	r.caughtUpWith(name)
+}
+
+// Fail handles the server failing by stopping the server's worker, rather than retrying
+// until the server recovers. A recovered server joins again, and the replication resumes
+// from its checkpoint.
+func (r *Replicator) Fail(name string) error {
+	return r.Leave(name)
+}
+
+// Update handles the server changing its address by restarting the server's worker with the
+// new address, resuming from its checkpoint
+func (r *Replicator) Update(name, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	w, ok := r.servers[name]
+	if !ok || w.addr == addr {
+		return nil
+	}
+	r.leave(name)
+	r.join(name, addr)
+	return nil
+}
+
+// JoinObserver ignores the observers joining, since they hold no records to copy
+func (r *Replicator) JoinObserver(name, addr string) error {
 	return nil
 }
 
 // Join method adds the given server address to the list of servers to
-// replicate and kicks off a goroutine to run the actual replication logic.
+// replicate and kicks off a worker to run the actual replication logic.
 func (r *Replicator) Join(name, addr string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.init()
 
+	r.join(name, addr)
+	return nil
+}
+
+func (r *Replicator) join(name, addr string) {
 	if r.closed {
-		return nil
+		return
 	}
 
 	if _, ok := r.servers[name]; ok {
 		// already replicating, so skip
-		return nil
+		return
 	}
 
-	r.servers[name] = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &worker{name: name, addr: addr, ctx: ctx, cancel: cancel, caughtUp: time.Now(), limit: newThrottle(r.PeerRateLimit)}
+	w.status.Addr = addr
+	r.servers[name] = w
 
-	go r.replicate(addr, r.servers[name])
+	r.workers.Add(1)
+	go r.run(w)
+	if r.Verify != nil {
+		r.workers.Add(1)
+		go r.verifyPeer(w)
+	}
+}
 
-	return nil
+// Peers reports the state of the replication of each server
+func (r *Replicator) Peers() map[string]PeerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peers := make(map[string]PeerStatus, len(r.servers))
+	for name, w := range r.servers {
+		w.mu.Lock()
+		status := w.status
+		status.LagTime = w.lagTime()
+		w.mu.Unlock()
+		peers[name] = status
+	}
+	return peers
+}
+
+// ReplicationStatus reports the state of the replication of each server, sorted by name,
+// for the admin API
+func (r *Replicator) ReplicationStatus() []*api.PeerReplicationStatus {
+	var statuses []*api.PeerReplicationStatus
+	for name, peer := range r.Peers() {
+		status := &api.PeerReplicationStatus{
+			Name:             name,
+			Addr:             peer.Addr,
+			State:            string(peer.State),
+			Connected:        peer.State == WorkerReplicating || peer.State == WorkerBootstrapping,
+			LastOffset:       peer.LastOffset,
+			HighWatermark:    peer.HighWatermark,
+			LagRecords:       peer.Lag,
+			LagSeconds:       peer.LagTime.Seconds(),
+			Failures:         uint32(peer.Failures),
+			DivergentRanges:  peer.Divergent,
+			ThrottledSeconds: peer.Throttled.Seconds(),
+		}
+		if peer.LastError != nil {
+			status.LastError = peer.LastError.Error()
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
 }
 
 // Close closes the replicator service, so it doesn't replicate new servers that join the
-// cluster, and it stops replicating existing servers by causing the replicate() goroutines to return
+// cluster, and it stops the workers replicating existing servers, waiting for them to return
 func (r *Replicator) Close() error {
 	r.mu.Lock()
-	r.mu.Unlock()
 	r.init()
 
 	if r.closed {
+		r.mu.Unlock()
 		return nil
 	}
 
 	r.closed = true
 	close(r.close)
+	for name, w := range r.servers {
+		w.cancel()
+		delete(r.servers, name)
+	}
+	r.mu.Unlock()
+
+	r.workers.Wait()
 	return nil
 }
 
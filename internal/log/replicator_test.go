@@ -15,6 +15,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,6 +25,14 @@ func TestReplicator(t *testing.T) {
 		"replicates the logs from a primary server":  testReplicatorJoin,
 		"replicator leaves the service successfully": testReplicatorLeave,
 		"replicator closes the service successfully": testReplicatorClose,
+		"replicator resumes from its checkpoint":     testReplicatorCheckpoint,
+		"replicator recovers from a crash":           testReplicatorCrash,
+		"replicator reconnects to a failed server":   testReplicatorReconnect,
+		"replicator bootstraps from the segments":    testReplicatorBootstrap,
+		"replicator repairs a divergent range":       testReplicatorRepair,
+		"replicator skips the unassigned origins":    testReplicatorAssigned,
+		"replicator throttles the fetches":           testReplicatorThrottle,
+		"replicator follows the updated address":     testReplicatorUpdate,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			r, primaryAddr, tearDownFn := setupTest(t)
@@ -36,12 +45,12 @@ func TestReplicator(t *testing.T) {
 func setupTest(t *testing.T) (*Replicator, string, func()) {
 	t.Helper()
 	ctx := context.Background()
-	ports := dynaport.Get(2)
+	port := dynaport.Get(1)[0]
 
 	// create the primary server and its tcp listener
-	lPrimary, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[0]))
+	lPrimary, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	require.NoError(t, err)
-	primary, dirPrimary := setupServer(t)
+	primary, _, dirPrimary := setupServer(t, "")
 	go func() {
 		_ = primary.Serve(lPrimary)
 	}()
@@ -59,33 +68,24 @@ func setupTest(t *testing.T) (*Replicator, string, func()) {
 		})
 	}
 
-	// create the secondary server and its tcp listener
-	lSecondary, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[1]))
+	// create the secondary log
+	dirSecondary, err := ioutil.TempDir("", "replicator-secondary-test")
 	require.NoError(t, err)
-	secondary, dirSecondary := setupServer(t)
-	go func() {
-		_ = secondary.Serve(lSecondary)
-	}()
-
-	// create a client for the secondary
-	clientOpts = setupClientOpts(t)
-	secondaryClientConn, err := grpc.Dial(lSecondary.Addr().String(), clientOpts...)
+	secondary, err := NewLog(dirSecondary, Config{})
 	require.NoError(t, err)
-	clientForSecondary := api.NewLogClient(secondaryClientConn)
 
-	// setup replicator with the secondary client and the primary client dial options
+	// setup replicator with the secondary log and the primary client dial options
 	r := Replicator{}
 	r.DialOptions = clientOpts
-	r.LocalServer = clientForSecondary
+	r.LocalLog = secondary
+	r.BatchRecords = 2
 
 	// teardown function
 	teardown := func() {
 		primary.Stop()
-		secondary.Stop()
 		_ = primaryClientConn.Close()
-		_ = secondaryClientConn.Close()
 		_ = lPrimary.Close()
-		_ = lSecondary.Close()
+		_ = secondary.Close()
 		_ = os.RemoveAll(dirPrimary)
 		_ = os.RemoveAll(dirSecondary)
 	}
@@ -94,20 +94,305 @@ func setupTest(t *testing.T) (*Replicator, string, func()) {
 }
 
 func testReplicatorJoin(t *testing.T, r *Replicator, primaryAddr string) {
-	ctx := context.Background()
 	err := r.Join("primary", primaryAddr)
 	require.NoError(t, err)
 
 	// wait until the replication finishes since the replication process is asynchronous
 	time.Sleep(2 * time.Second)
 
+	// the records were copied in batches of two, keeping their offset on the primary
+	for i := 0; i < 3; i++ {
+		record, err := r.LocalLog.(*Log).Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, []byte(fmt.Sprintf("hello, world %d", i+1)))
+		require.Equal(t, "primary", record.Origin)
+		require.Equal(t, uint64(i), record.OriginOffset)
+	}
+
+	// the replicator is caught up with the primary
+	status := r.Peers()["primary"]
+	require.Equal(t, WorkerReplicating, status.State)
+	require.Equal(t, uint64(2), status.LastOffset)
+	require.Equal(t, uint64(3), status.HighWatermark)
+	require.Equal(t, uint64(0), status.Lag)
+	require.Equal(t, time.Duration(0), status.LagTime)
+	require.Len(t, r.ReplicationStatus(), 1)
+}
+
+func testReplicatorAssigned(t *testing.T, r *Replicator, primaryAddr string) {
+	var assigned int32
+	r.Assigned = func(origin string) bool {
+		return origin != "primary" || atomic.LoadInt32(&assigned) == 1
+	}
+	err := r.Join("primary", primaryAddr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return r.Peers()["primary"].LastOffset == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the records were skipped, although the replicator is caught up with the primary
+	require.Equal(t, uint64(0), r.LocalLog.(*Log).HighWatermark())
+	require.Equal(t, uint64(0), r.Peers()["primary"].Lag)
+	require.Equal(t, uint64(0), r.Checkpoints.OriginOffset("primary"))
+
+	// once the replicator is assigned the primary's records, it copies the ones it skipped
+	atomic.StoreInt32(&assigned, 1)
+	require.Eventually(t, func() bool {
+		return r.LocalLog.(*Log).HighWatermark() == 3
+	}, 3*time.Second, 10*time.Millisecond)
 	for i := 0; i < 3; i++ {
-		res, err := r.LocalServer.Consume(ctx, &api.ConsumeRequest{Offset: uint64(i)})
+		record, err := r.LocalLog.(*Log).Read(uint64(i))
 		require.NoError(t, err)
-		require.Equal(t, res.Record.Value, []byte(fmt.Sprintf("hello, world %d", i+1)))
+		require.Equal(t, uint64(i), record.OriginOffset)
 	}
 }
 
+func testReplicatorThrottle(t *testing.T, r *Replicator, primaryAddr string) {
+	r.PeerRateLimit = 100
+	err := r.Join("primary", primaryAddr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return r.Peers()["primary"].LastOffset == 2
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// the fetches were delayed for the bytes copied to meet the rate
+	require.NotZero(t, r.Peers()["primary"].Throttled)
+	require.Equal(t, uint64(100), r.Throttle().PeerBytesPerSecond)
+	status := r.ReplicationStatus()
+	require.Greater(t, status[0].ThrottledSeconds, float64(0))
+
+	// and the limit is lifted at runtime
+	r.SetThrottle(&api.ReplicationThrottle{TotalBytesPerSecond: 1 << 20})
+	require.Equal(t, uint64(1<<20), r.Throttle().TotalBytesPerSecond)
+	require.Equal(t, uint64(0), r.Throttle().PeerBytesPerSecond)
+}
+
+func testReplicatorUpdate(t *testing.T, r *Replicator, primaryAddr string) {
+	// the primary moves to the address it listens on
+	err := r.Join("primary", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+	require.NoError(t, err)
+	require.NoError(t, r.Update("primary", primaryAddr))
+	require.Eventually(t, func() bool {
+		return r.Peers()["primary"].LastOffset == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, primaryAddr, r.Peers()["primary"].Addr)
+
+	// a failed server isn't replicated until it joins again
+	require.NoError(t, r.Fail("primary"))
+	require.Empty(t, r.Peers())
+}
+
+func testReplicatorCheckpoint(t *testing.T, r *Replicator, primaryAddr string) {
+	dir, err := ioutil.TempDir("", "replicator-checkpoint-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the first two records were copied before
+	r.Checkpoints, err = NewCheckpoints(dir)
+	require.NoError(t, err)
+	r.Checkpoints.Set("primary", 2, nil)
+
+	err = r.Join("primary", primaryAddr)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+
+	record, err := r.LocalLog.(*Log).Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello, world 3"), record.Value)
+	_, err = r.LocalLog.(*Log).Read(1)
+	require.Error(t, err)
+
+	// the checkpoint survives a restart
+	checkpoints, err := NewCheckpoints(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), checkpoints.Offset("primary"))
+}
+
+func testReplicatorCrash(t *testing.T, r *Replicator, primaryAddr string) {
+	dir, err := ioutil.TempDir("", "replicator-crash-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the records are copied, but the process crashes before the checkpoints are flushed
+	r.Checkpoints, err = NewCheckpoints(dir)
+	require.NoError(t, err)
+	r.CheckpointInterval = time.Hour
+	require.NoError(t, r.Join("primary", primaryAddr))
+	local := r.LocalLog.(*Log)
+	require.Eventually(t, func() bool {
+		return local.HighWatermark() == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, r.Leave("primary"))
+
+	// the records the log kept aren't copied again
+	checkpoints, err := NewCheckpoints(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), checkpoints.Offset("primary"))
+	require.NoError(t, checkpoints.Recover(local))
+	restarted := &Replicator{DialOptions: r.DialOptions, LocalLog: local, Checkpoints: checkpoints}
+	defer restarted.Close()
+	require.NoError(t, restarted.Join("primary", primaryAddr))
+	require.Eventually(t, func() bool {
+		return restarted.Peers()["primary"].LastOffset == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(3), local.HighWatermark())
+
+	// and a log that lost them copies them again, rather than skipping them
+	lostDir, err := ioutil.TempDir("", "replicator-crash-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(lostDir)
+	lost, err := NewLog(lostDir, Config{})
+	require.NoError(t, err)
+	defer lost.Close()
+	checkpoints, err = NewCheckpoints(dir)
+	require.NoError(t, err)
+	require.NoError(t, checkpoints.Recover(lost))
+	restarted = &Replicator{DialOptions: r.DialOptions, LocalLog: lost, Checkpoints: checkpoints}
+	defer restarted.Close()
+	require.NoError(t, restarted.Join("primary", primaryAddr))
+	require.Eventually(t, func() bool {
+		return lost.HighWatermark() == 3
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func testReplicatorBootstrap(t *testing.T, r *Replicator, primaryAddr string) {
+	ctx := context.Background()
+	conn, err := grpc.Dial(primaryAddr, setupClientOpts(t)...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// fill a few segments of the primary
+	for i := 3; i < 100; i++ {
+		_, err = api.NewLogClient(conn).Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("hello, world %d", i+1))},
+		})
+		require.NoError(t, err)
+	}
+
+	local := r.LocalLog.(*Log)
+	r.Bootstrap = local
+	err = r.Join("primary", primaryAddr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return local.HighWatermark() == 100
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the records of the sealed segments were imported as they are, and the ones of the
+	// active segment were fetched
+	first, err := local.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello, world 1"), first.Value)
+	require.Equal(t, "", first.Origin)
+	last, err := local.Read(99)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello, world 100"), last.Value)
+	require.Equal(t, "primary", last.Origin)
+
+	require.Equal(t, uint64(100), r.Checkpoints.Offset("primary"))
+	require.Equal(t, uint64(100), r.Checkpoints.OriginOffset("primary"))
+}
+
+func testReplicatorRepair(t *testing.T, r *Replicator, _ string) {
+	ctx := context.Background()
+	addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	healthy, _, dir := setupServer(t, "healthy")
+	defer func() {
+		healthy.Stop()
+		_ = os.RemoveAll(dir)
+	}()
+	go func() {
+		_ = healthy.Serve(ln)
+	}()
+
+	conn, err := grpc.Dial(addr, setupClientOpts(t)...)
+	require.NoError(t, err)
+	defer conn.Close()
+	produce := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := api.NewLogClient(conn).Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+			require.NoError(t, err)
+		}
+	}
+
+	local := r.LocalLog.(*Log)
+	produce(6)
+	err = r.Join("healthy", addr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return local.HighWatermark() == 6
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the local log loses the records from origin offset 2 to 6, and goes on replicating
+	require.NoError(t, local.TruncateFrom(2))
+	produce(4)
+	require.Eventually(t, func() bool {
+		return local.HighWatermark() == 6
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, r.Leave("healthy"))
+	r.Verify = local
+	r.DigestRangeSize = 2
+	w := &worker{name: "healthy", addr: addr, ctx: ctx}
+
+	// the divergent ranges are reported
+	require.NoError(t, r.verify(w))
+	require.Equal(t, []*api.DivergentRange{
+		{Origin: "healthy", Start: 2, End: 4, LocalRecords: 0, PeerRecords: 2},
+		{Origin: "healthy", Start: 4, End: 6, LocalRecords: 0, PeerRecords: 2},
+	}, w.status.Divergent)
+	require.Equal(t, uint64(6), local.HighWatermark())
+
+	// and repaired from the healthy server
+	r.RepairFrom = "healthy"
+	require.NoError(t, r.verify(w))
+	require.Equal(t, uint64(10), local.HighWatermark())
+	require.NoError(t, r.verify(w))
+	require.Empty(t, w.status.Divergent)
+}
+
+func testReplicatorReconnect(t *testing.T, r *Replicator, _ string) {
+	ctx := context.Background()
+	r.InitialBackoff = 10 * time.Millisecond
+	r.MaxBackoff = 50 * time.Millisecond
+
+	// nothing listens on the address yet
+	addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	err := r.Join("late", addr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		peer := r.Peers()["late"]
+		return peer.State == WorkerBackingOff && peer.Failures > 1 && peer.LastError != nil
+	}, time.Second, 10*time.Millisecond)
+
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	late, _, dir := setupServer(t, "")
+	defer func() {
+		late.Stop()
+		_ = os.RemoveAll(dir)
+	}()
+	go func() {
+		_ = late.Serve(ln)
+	}()
+
+	conn, err := grpc.Dial(addr, setupClientOpts(t)...)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = api.NewLogClient(conn).Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("late")}})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		record, err := r.LocalLog.(*Log).Read(0)
+		return err == nil && string(record.Value) == "late"
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		peer := r.Peers()["late"]
+		return peer.State == WorkerReplicating && peer.Failures == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
 func testReplicatorLeave(t *testing.T, r *Replicator, primaryAddr string) {
 	err := r.Join("primary", primaryAddr)
 	require.NoError(t, err)
@@ -128,9 +413,10 @@ func testReplicatorClose(t *testing.T, r *Replicator, primaryAddr string) {
 	require.True(t, r.closed)
 	_, isOpen := <-r.close
 	require.False(t, isOpen)
+	require.Empty(t, r.Peers())
 }
 
-func setupServer(t *testing.T) (*grpc.Server, string) {
+func setupServer(t *testing.T, origin string) (*server.Server, *Log, string) {
 	t.Helper()
 	// setup grpcServer creds
 	serverTlsConfig, err := tlsConfig.SetupTLSConfig(tlsConfig.TLSConfig{
@@ -147,7 +433,9 @@ func setupServer(t *testing.T) (*grpc.Server, string) {
 	dir, err := ioutil.TempDir("", fmt.Sprintf("replication-%d", rand.Int()))
 	require.NoError(t, err)
 
-	cLog, err := NewLog(dir, Config{})
+	c := Config{}
+	c.Origin = origin
+	cLog, err := NewLog(dir, c)
 	require.NoError(t, err)
 	authorizer := auth.New(tlsConfig.ACLModelFile, tlsConfig.ACLPolicyFile)
 
@@ -156,7 +444,7 @@ func setupServer(t *testing.T) (*grpc.Server, string) {
 	grpcServer, err := server.NewGRPCServer(&cfg, grpc.Creds(tlsCreds))
 	require.NoError(t, err)
 
-	return grpcServer, dir
+	return grpcServer, cLog, dir
 }
 
 func setupClientOpts(t *testing.T) []grpc.DialOption {
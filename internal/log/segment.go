@@ -12,11 +12,20 @@ import (
 //
 // The next and base offsets are needed to see what offset to append new records under
 // and to calculate the relative offsets for the index entries.
+//
+// A segment being shipped is pinned, so that removing it from the log only unlinks its files,
+// and it's closed once the last pin is released.
+//
+// The digest of a sealed segment's records is cached, since its records don't change until it's
+// truncated.
 type segment struct {
 	store                  *store
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	pins                   int
+	removed                bool
+	digest                 *segmentDigest
 }
 
 // newSegment is called when there's a need to add a new segment, such as when the current
@@ -24,27 +33,40 @@ type segment struct {
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{baseOffset: baseOffset, config: c}
 
+	storeFlag, indexFlag := os.O_RDWR|os.O_CREATE|os.O_APPEND, os.O_RDWR|os.O_CREATE
+	if c.ReadOnly {
+		storeFlag, indexFlag = os.O_RDONLY, os.O_RDONLY
+	}
+
 	var err error
-	storeFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644,
-	)
+	storeFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")), storeFlag, 0644)
 	if err != nil {
 		return nil, err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
+	if s.store, err = newStore(storeFile, c); err != nil {
+		_ = storeFile.Close()
 		return nil, err
 	}
 
-	indexFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE, 0644,
-	)
+	indexFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), indexFlag, 0644)
 	if err != nil {
+		_ = storeFile.Close()
 		return nil, err
 	}
 	if s.index, err = newIndex(indexFile, c); err != nil {
+		_ = indexFile.Close()
+		_ = storeFile.Close()
 		return nil, err
 	}
 
+	if c.ReadOnly {
+		if err = s.refresh(); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+
 	var off uint32
 	if off, _, err = s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
@@ -59,6 +81,9 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
+	if record.Origin == "" && s.config.Origin != "" {
+		record.Origin, record.OriginOffset = s.config.Origin, cur
+	}
 
 	p, err := proto.Marshal(record)
 	if err != nil {
@@ -80,6 +105,51 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	return cur, nil
 }
 
+// refresh picks up the records appended to a read-only segment by the process writing to it.
+// Only the records that are completely in the store are counted.
+func (s *segment) refresh() error {
+	if err := s.store.Refresh(); err != nil {
+		return err
+	}
+	if err := s.index.Refresh(s.store.Contains); err != nil {
+		return err
+	}
+
+	s.nextOffset = s.baseOffset
+	if off, _, err := s.index.Read(-1); err == nil {
+		s.nextOffset = s.baseOffset + uint64(off) + 1
+	}
+	return nil
+}
+
+// truncate removes the records from the given offset on, which must be in the segment
+func (s *segment) truncate(off uint64) error {
+	s.digest = nil
+	if off >= s.nextOffset {
+		// nothing to remove, but the store may have been sealed and is appended to again
+		return s.store.Truncate(s.store.size)
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return err
+	}
+	if err = s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.Truncate(off - s.baseOffset)
+	s.nextOffset = off
+	return nil
+}
+
+// Sync flushes the segment's records to stable storage, the store's before the index's so
+// that the index never points past the records of the store
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
 // Read returns the record for the given index offset.
 func (s *segment) Read(off uint64) (*api.Record, error) {
 	_, pos, err := s.index.Read(int64(off - s.baseOffset))
@@ -126,6 +196,27 @@ func (s *segment) Remove() error {
 	return nil
 }
 
+// release removes the segment, or only unlinks its files while it's pinned
+func (s *segment) release() error {
+	if s.pins == 0 {
+		return s.Remove()
+	}
+	s.removed = true
+	if err := os.Remove(s.index.Name()); err != nil {
+		return err
+	}
+	return os.Remove(s.store.Name())
+}
+
+// unpin releases a pin of the segment, closing it if it was removed in the meantime
+func (s *segment) unpin() error {
+	s.pins--
+	if s.pins == 0 && s.removed {
+		return s.Close()
+	}
+	return nil
+}
+
 // nearestMultiple returns the nearest and lesser multiple of k in j.
 //
 // for example nearestMultiple(9, 4) == 8. We take the lesser multiple to
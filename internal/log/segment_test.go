@@ -1,6 +1,7 @@
 package log
 
 import (
+	"fmt"
 	api "github.com/pandulaDW/go-distributed-service/api/v1"
 	"github.com/stretchr/testify/require"
 	"io"
@@ -57,3 +58,48 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+// BenchmarkSegment_Read compares reading records of a sealed segment through pread
+// syscalls against reading them from the read-only memory mapping of its store.
+func BenchmarkSegment_Read(b *testing.B) {
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%t", mmap), func(b *testing.B) {
+			dir, _ := ioutil.TempDir("", "segment-bench")
+			defer func(path string) {
+				_ = os.RemoveAll(path)
+			}(dir)
+
+			const records = 1024
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Segment.MaxIndexBytes = entWidth * records
+			c.Segment.FormatVersion = LatestFormat
+			s, err := newSegment(dir, 0, c)
+			require.NoError(b, err)
+			defer func() {
+				_ = s.Close()
+			}()
+
+			record := &api.Record{Value: make([]byte, 256)}
+			for i := 0; i < records; i++ {
+				_, err = s.Append(record)
+				require.NoError(b, err)
+			}
+			if mmap {
+				require.NoError(b, s.store.Seal())
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				off := uint64(0)
+				for pb.Next() {
+					if _, err := s.Read(off % records); err != nil {
+						b.Fatal(err)
+					}
+					off++
+				}
+			})
+		})
+	}
+}
@@ -3,6 +3,11 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/tysonmote/gommap"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
 )
@@ -10,41 +15,63 @@ import (
 var (
 	// enc defines the encoding that we persist record sizes and index entries in
 	enc = binary.BigEndian
+	// crcTable is the CRC32 polynomial table used for record checksums
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// ErrChecksumMismatch is returned when reading a record that doesn't match its checksum
+	ErrChecksumMismatch = errors.New("record checksum mismatch")
 )
 
 const (
 	// lenWidth defines the number of bytes used to store the record’s length
 	lenWidth = 8
+	// crcWidth defines the number of bytes used to store the record's checksum, from FormatV2
+	crcWidth = 4
 )
 
 // store is a simple wrapper around a file with two APIs to append and
 // read bytes to and from the file
+//
+// Once sealed, the file is memory-mapped read-only and reads are served from the mapping.
 type store struct {
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	mu        sync.Mutex
+	buf       *bufio.Writer
+	size      uint64
+	checksums bool
+	mmap      gommap.MMap
 }
 
-// newStore creates a store for the given file
-func newStore(f *os.File) (*store, error) {
+// newStore creates a store for the given file, laid out in the configured format version
+func newStore(f *os.File, c Config) (*store, error) {
 	fileInfo, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	size := uint64(fileInfo.Size())
 	return &store{
-		File: f,
-		mu:   sync.Mutex{},
-		buf:  bufio.NewWriter(f),
-		size: size,
+		File:      f,
+		mu:        sync.Mutex{},
+		buf:       bufio.NewWriter(f),
+		size:      size,
+		checksums: c.Segment.FormatVersion >= FormatV2,
 	}, nil
 }
 
+// headerWidth returns the number of bytes stored in front of each record
+func (s *store) headerWidth() uint64 {
+	if s.checksums {
+		return lenWidth + crcWidth
+	}
+	return lenWidth
+}
+
 // Append persists the given bytes to the store.
 //
 // It returns the number of bytes written, the position where the store holds the
 // record in its file and an error if any occurred.
+//
+// The record is held by the buffered writer until the next Flush, or until the writer is
+// full.
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -56,13 +83,20 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 		return 0, 0, err
 	}
 
+	// followed by its checksum
+	if s.checksums {
+		if err = binary.Write(s.buf, enc, crc32.Checksum(p, crcTable)); err != nil {
+			return 0, 0, err
+		}
+	}
+
 	// writing the log record
 	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	w += lenWidth
+	w += int(s.headerWidth())
 	s.size += uint64(w)
 
 	return uint64(w), pos, err
@@ -70,6 +104,10 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 
 // Read returns the record stored at the given position
 func (s *store) Read(pos uint64) ([]byte, error) {
+	if s.mmap != nil {
+		return s.readMapped(pos)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -78,21 +116,99 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
-	// reading the size of the record
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	// reading the size of the record, and its checksum
+	header := make([]byte, s.headerWidth())
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
 		return nil, err
 	}
 
 	// reading the record
-	record := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(record, int64(pos+lenWidth)); err != nil {
+	record := make([]byte, enc.Uint64(header))
+	if _, err := s.File.ReadAt(record, int64(pos+s.headerWidth())); err != nil {
 		return nil, err
 	}
 
+	if s.checksums && crc32.Checksum(record, crcTable) != enc.Uint32(header[lenWidth:]) {
+		return nil, fmt.Errorf("%w at position %d of %s", ErrChecksumMismatch, pos, s.Name())
+	}
+
 	return record, nil
 }
 
+// readMapped returns the record stored at the given position from the read-only mapping of
+// a sealed store. The mapping never changes, so it's read without taking the lock.
+func (s *store) readMapped(pos uint64) ([]byte, error) {
+	headerEnd := pos + s.headerWidth()
+	if headerEnd > uint64(len(s.mmap)) {
+		return nil, io.EOF
+	}
+	header := s.mmap[pos:headerEnd]
+
+	end := headerEnd + enc.Uint64(header)
+	if end > uint64(len(s.mmap)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	record := make([]byte, end-headerEnd)
+	copy(record, s.mmap[headerEnd:end])
+
+	if s.checksums && crc32.Checksum(record, crcTable) != enc.Uint32(header[lenWidth:]) {
+		return nil, fmt.Errorf("%w at position %d of %s", ErrChecksumMismatch, pos, s.Name())
+	}
+
+	return record, nil
+}
+
+// Refresh updates the size of a store another process is appending to
+func (s *store) Refresh() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fileInfo, err := s.File.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = uint64(fileInfo.Size())
+	return nil
+}
+
+// Contains reports whether a complete record starts at the given position of the store's
+// file, not counting the records still held by the buffered writer.
+func (s *store) Contains(pos uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pos+s.headerWidth() > s.size {
+		return false, nil
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+		return false, err
+	}
+	return pos+s.headerWidth()+enc.Uint64(size) <= s.size, nil
+}
+
+// Seal flushes the store and memory-maps its file read-only, so that reads no longer need
+// a syscall. It's called once the store won't be appended to anymore, and must not run
+// concurrently with reads.
+func (s *store) Seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mmap != nil || s.size == 0 {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	mmap, err := gommap.MapRegion(s.File.Fd(), 0, int64(s.size), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.mmap = mmap
+	return nil
+}
+
 // ReadAt reads len(p) bytes into p starting at offset off in the store’s file.
 //
 // It implements io.ReaderAt on the store type.
@@ -107,11 +223,67 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
-// Close flushes any buffered data and close the underlying file
+// Sync flushes the store's file to stable storage
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Flush writes the records held by the buffered writer to the store's file
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Discard drops the bytes still held by the buffered writer, including the sticky error it
+// keeps after a failed flush. It's used to recover from a failed write, after which the
+// caller truncates the store to the end of the records it keeps.
+func (s *store) Discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf.Reset(s.File)
+}
+
+// Truncate cuts the store's file down to the given size, removing any partially
+// written record past it. A sealed store is unmapped, since it's being written to again.
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if s.mmap != nil {
+		if err := s.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// Close flushes any buffered data, unmaps a sealed store and close the underlying file
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.mmap != nil {
+		if err := s.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
+
 	if err := s.buf.Flush(); err != nil {
 		return err
 	}
@@ -1,7 +1,9 @@
 package log
 
 import (
+	"errors"
 	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -12,6 +14,13 @@ var (
 	width = uint64(len(write)) + lenWidth
 )
 
+// v1Config lays the store out in FormatV1, where records only carry their length
+func v1Config() Config {
+	c := Config{}
+	c.Segment.FormatVersion = FormatV1
+	return c
+}
+
 func TestStore_AppendRead(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_append_read_test")
 	require.NoError(t, err)
@@ -19,14 +28,14 @@ func TestStore_AppendRead(t *testing.T) {
 		_ = os.Remove(name)
 	}(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, v1Config())
 	require.NoError(t, err)
 
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
 
-	s, err = newStore(f)
+	s, err = newStore(f, v1Config())
 	require.NoError(t, err)
 	testRead(t, s)
 }
@@ -73,6 +82,56 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStore_Checksums(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksums_test")
+	require.NoError(t, err)
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(f.Name())
+
+	c := Config{}
+	c.Segment.FormatVersion = FormatV2
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+
+	n, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, width+crcWidth, n)
+
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	// flip a bit of the record on disk
+	require.NoError(t, s.buf.Flush())
+	_, err = f.WriteAt([]byte{write[0] ^ 1}, int64(pos+lenWidth+crcWidth))
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	require.True(t, errors.Is(err, ErrChecksumMismatch))
+}
+
+func TestStore_Seal(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_seal_test")
+	require.NoError(t, err)
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(f.Name())
+
+	s, err := newStore(f, v1Config())
+	require.NoError(t, err)
+	testAppend(t, s)
+
+	require.NoError(t, s.Seal())
+	require.NotNil(t, s.mmap)
+	testRead(t, s)
+	testReadAt(t, s)
+
+	_, err = s.Read(width * 3)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, s.Close())
+}
+
 func TestStore_Close(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -80,7 +139,7 @@ func TestStore_Close(t *testing.T) {
 		_ = os.Remove(name)
 	}(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, v1Config())
 	require.NoError(t, err)
 	_, _, err = s.Append(write)
 	require.NoError(t, err)
@@ -0,0 +1,102 @@
+package log
+
+import (
+	"context"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"sync"
+	"time"
+)
+
+// throttle limits the rate of the bytes replicated, in bytes per second. The bytes are paid
+// for after they're taken, so a batch goes through at once and delays the ones following it
+// until the rate is met. A rate of 0 leaves the bytes unlimited.
+type throttle struct {
+	mu   sync.Mutex
+	rate uint64
+	// paid is when the bytes taken so far are paid for
+	paid time.Time
+}
+
+func newThrottle(rate uint64) *throttle {
+	return &throttle{rate: rate}
+}
+
+// setRate replaces the rate, the bytes taken so far being paid for at the previous rate
+func (t *throttle) setRate(rate uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate = rate
+}
+
+// take takes n bytes, returning how long the caller must wait before taking more
+func (t *throttle) take(n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	if t.paid.Before(now) {
+		// the bytes that weren't taken in time don't add up to a burst
+		t.paid = now
+	}
+	t.paid = t.paid.Add(time.Duration(uint64(n) * uint64(time.Second) / t.rate))
+	return t.paid.Sub(now)
+}
+
+// SetThrottle replaces the rate limits of the replication at runtime, in bytes per second, in
+// total and for each server. A limit of 0 leaves the rate unlimited.
+func (r *Replicator) SetThrottle(limits *api.ReplicationThrottle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	r.RateLimit = limits.GetTotalBytesPerSecond()
+	r.PeerRateLimit = limits.GetPeerBytesPerSecond()
+	r.limit.setRate(r.RateLimit)
+	for _, w := range r.servers {
+		w.limit.setRate(r.PeerRateLimit)
+	}
+}
+
+// Throttle returns the current rate limits of the replication
+func (r *Replicator) Throttle() *api.ReplicationThrottle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &api.ReplicationThrottle{TotalBytesPerSecond: r.RateLimit, PeerBytesPerSecond: r.PeerRateLimit}
+}
+
+// throttle waits until the worker can copy more bytes from the server after copying n bytes,
+// recording how long it waited in the worker's status and the throttling metric
+func (r *Replicator) throttle(w *worker, n int) error {
+	wait := r.limit.take(n)
+	if peerWait := w.limit.take(n); peerWait > wait {
+		wait = peerWait
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	w.addThrottled(wait)
+	if ctx, err := tag.New(context.Background(), tag.Upsert(peerKey, w.name)); err == nil {
+		stats.Record(ctx, throttledSeconds.M(wait.Seconds()))
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (w *worker) addThrottled(wait time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.Throttled += wait
+}
@@ -0,0 +1,26 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	throttle := newThrottle(1000)
+
+	// the bytes taken are paid for at the rate, one batch after the other
+	wait := throttle.take(500)
+	require.InDelta(t, 500*time.Millisecond, wait, float64(10*time.Millisecond))
+	wait = throttle.take(500)
+	require.InDelta(t, time.Second, wait, float64(10*time.Millisecond))
+
+	// the new rate applies to the bytes taken next
+	throttle.setRate(2000)
+	wait = throttle.take(1000)
+	require.InDelta(t, 1500*time.Millisecond, wait, float64(10*time.Millisecond))
+
+	// without a rate, the bytes are unlimited
+	throttle.setRate(0)
+	require.Equal(t, time.Duration(0), throttle.take(1<<20))
+}
@@ -0,0 +1,279 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/pandulaDW/go-distributed-service/internal/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// remoteCheckpoint is the name the offset of the next record of the remote cluster's log to
+// mirror is recorded under
+const remoteCheckpoint = "remote"
+
+// Config configures a Mirror.
+//
+// RemoteAddr is the address of a server of the remote cluster, which the mirror consumes with
+// RemoteTLSConfig, and LocalAddr the one of a server of the local cluster, which it produces to
+// with LocalTLSConfig. The clusters being run apart, each has its own certificates.
+//
+// The log has a single stream of records, so only the records whose value starts with one of
+// Prefixes are mirrored, or every record when there are none.
+//
+// Cluster is the name of the local cluster and RemoteCluster the one of the remote cluster. The
+// mirrored records carry the name of the cluster they were first produced to, and the ones that
+// came from the local cluster aren't mirrored back, so that two clusters can mirror each other.
+//
+// Dir holds the mirror's checkpoint and offset translation table, and is dedicated to the mirror.
+// The checkpoint is written every CheckpointInterval, once the translation table is synced.
+// The mirror reconnects after a failure with an exponential backoff, growing from InitialBackoff
+// up to MaxBackoff.
+type Config struct {
+	RemoteAddr         string
+	RemoteTLSConfig    *tls.Config
+	LocalAddr          string
+	LocalTLSConfig     *tls.Config
+	Prefixes           [][]byte
+	Cluster            string
+	RemoteCluster      string
+	Dir                string
+	CheckpointInterval time.Duration
+	InitialBackoff     time.Duration
+	MaxBackoff         time.Duration
+}
+
+// Mirror copies the records of a remote cluster into the local cluster, such as the cluster of
+// another region, by consuming the remote cluster's ConsumeStream and producing each record to
+// the local cluster.
+//
+// It checkpoints the offset of the next remote record to mirror, so that it resumes where it
+// stopped when it restarts, and records the local offset each remote record was produced at in
+// a translation table, so that the consumers of the remote cluster can fail over to the local
+// cluster. The records the translation table holds past the checkpoint when the mirror starts
+// were produced already, so the checkpoint is moved past them. A record produced again after a
+// crash, before its entry reached the translation table, is mirrored twice.
+type Mirror struct {
+	Config
+	checkpoints *log.Checkpoints
+	table       *translationTable
+	logger      *zap.Logger
+	ctx         context.Context
+	cancel      context.CancelFunc
+	workers     sync.WaitGroup
+}
+
+// New creates a Mirror, loading its checkpoint and translation table from Dir, and starts
+// mirroring the remote cluster in a goroutine
+func New(config Config) (*Mirror, error) {
+	if config.Cluster == "" || config.RemoteCluster == "" {
+		return nil, fmt.Errorf("the names of the local and remote clusters are required")
+	}
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = time.Second
+	}
+	if config.InitialBackoff == 0 {
+		config.InitialBackoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 10 * time.Second
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	checkpoints, err := log.NewCheckpoints(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	table, err := openTranslationTable(filepath.Join(config.Dir, translationsFile))
+	if err != nil {
+		return nil, err
+	}
+	if next, ok := table.next(); ok && next > checkpoints.Offset(remoteCheckpoint) {
+		checkpoints.Set(remoteCheckpoint, next, nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Mirror{
+		Config:      config,
+		checkpoints: checkpoints,
+		table:       table,
+		logger:      zap.L().Named("mirror"),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	m.workers.Add(2)
+	go m.run()
+	go m.flushCheckpoint()
+	return m, nil
+}
+
+// Offset returns the offset of the next record of the remote cluster's log to mirror
+func (m *Mirror) Offset() uint64 {
+	return m.checkpoints.Offset(remoteCheckpoint)
+}
+
+// Translate returns the offset to consume the local cluster's log from for a consumer that
+// consumed the remote cluster's log up to the remote offset, excluded: the local offset of the
+// first record mirrored from that offset on. It returns false when no record was mirrored
+// from that offset on yet.
+func (m *Mirror) Translate(remoteOffset uint64) (uint64, bool) {
+	return m.table.translate(remoteOffset)
+}
+
+// Close stops mirroring, waiting for the record being mirrored, and writes the checkpoint
+func (m *Mirror) Close() error {
+	m.cancel()
+	m.workers.Wait()
+	if err := m.flush(); err != nil {
+		_ = m.table.close()
+		return err
+	}
+	return m.table.close()
+}
+
+// flushCheckpoint writes the checkpoint every CheckpointInterval, until the mirror closes
+func (m *Mirror) flushCheckpoint() {
+	defer m.workers.Done()
+
+	ticker := time.NewTicker(m.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := m.flush(); err != nil {
+			m.logger.Error("writing the mirror checkpoint failed", zap.Error(err))
+		}
+	}
+}
+
+// flush syncs the translation table and writes the checkpoint, so that the checkpoint never
+// moves past records whose entries the table lost
+func (m *Mirror) flush() error {
+	return m.checkpoints.Flush(0, m.table.sync)
+}
+
+// run mirrors the remote cluster, reconnecting after each failure until the mirror closes
+func (m *Mirror) run() {
+	defer m.workers.Done()
+
+	backoff := m.InitialBackoff
+	for {
+		mirrored, err := m.mirror()
+		if m.ctx.Err() != nil {
+			return
+		}
+		// a mirror that made progress starts backing off anew
+		if mirrored {
+			backoff = m.InitialBackoff
+		}
+		m.logger.Error("mirroring failed, reconnecting", zap.Error(err),
+			zap.String("remote_addr", m.RemoteAddr), zap.String("local_addr", m.LocalAddr))
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > m.MaxBackoff {
+			backoff = m.MaxBackoff
+		}
+	}
+}
+
+// mirror streams the records of the remote cluster from the checkpoint and produces them to
+// the local cluster, until a call fails or the mirror closes. It reports whether it mirrored
+// any record.
+func (m *Mirror) mirror() (bool, error) {
+	remoteConn, err := grpc.Dial(m.RemoteAddr, dialOptions(m.RemoteTLSConfig)...)
+	if err != nil {
+		return false, err
+	}
+	defer func(conn *grpc.ClientConn) {
+		_ = conn.Close()
+	}(remoteConn)
+	localConn, err := grpc.Dial(m.LocalAddr, dialOptions(m.LocalTLSConfig)...)
+	if err != nil {
+		return false, err
+	}
+	defer func(conn *grpc.ClientConn) {
+		_ = conn.Close()
+	}(localConn)
+
+	local := api.NewLogClient(localConn)
+	stream, err := api.NewLogClient(remoteConn).ConsumeStream(m.ctx, &api.ConsumeRequest{Offset: m.Offset()})
+	if err != nil {
+		return false, err
+	}
+
+	mirrored := false
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return mirrored, err
+		}
+		if err = m.mirrorRecord(local, res.Record); err != nil {
+			return mirrored, err
+		}
+		mirrored = true
+	}
+}
+
+// mirrorRecord produces the remote record to the local cluster, unless it's filtered out or was
+// first produced to the local cluster, and moves the checkpoint past it, which the next flush
+// writes
+func (m *Mirror) mirrorRecord(local api.LogClient, record *api.Record) error {
+	cluster := record.Cluster
+	if cluster == "" {
+		cluster = m.RemoteCluster
+	}
+	if cluster != m.Cluster && m.matches(record) {
+		// the record is produced anew, its origin in the remote cluster meaningless locally
+		res, err := local.Produce(m.ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: record.Value, Cluster: cluster},
+		})
+		if err != nil {
+			return err
+		}
+		if err = m.table.add(record.Offset, res.Offset); err != nil {
+			return err
+		}
+	}
+	m.checkpoints.Set(remoteCheckpoint, record.Offset+1, nil)
+	return nil
+}
+
+// matches reports whether the record passes the prefix filters
+func (m *Mirror) matches(record *api.Record) bool {
+	if len(m.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range m.Prefixes {
+		if bytes.HasPrefix(record.Value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialOptions returns the gRPC dial options to connect to a cluster with
+func dialOptions(tlsConfig *tls.Config) []grpc.DialOption {
+	var opts []grpc.DialOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
+	return opts
+}
@@ -0,0 +1,156 @@
+package mirror
+
+import (
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"github.com/pandulaDW/go-distributed-service/internal/auth"
+	"github.com/pandulaDW/go-distributed-service/internal/config"
+	"github.com/pandulaDW/go-distributed-service/internal/log"
+	"github.com/pandulaDW/go-distributed-service/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	remoteAddr, remoteLog, stopRemote := setupCluster(t)
+	defer stopRemote()
+	localAddr, localLog, stopLocal := setupCluster(t)
+	defer stopLocal()
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	produce := func(values ...string) {
+		for _, value := range values {
+			_, err := remoteLog.Append(&api.Record{Value: []byte(value), Origin: "remote-0"})
+			require.NoError(t, err)
+		}
+	}
+	produce("orders-1", "payments-1", "orders-2")
+
+	dir, err := ioutil.TempDir("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	mirrorConfig := Config{
+		RemoteAddr:      remoteAddr,
+		RemoteTLSConfig: clientTLSConfig,
+		LocalAddr:       localAddr,
+		LocalTLSConfig:  clientTLSConfig,
+		Prefixes:        [][]byte{[]byte("orders-")},
+		Dir:             dir,
+		Cluster:         "local",
+		RemoteCluster:   "remote",
+	}
+	m, err := New(mirrorConfig)
+	require.NoError(t, err)
+
+	// only the records passing the filters are mirrored, produced anew to the local cluster
+	require.Eventually(t, func() bool {
+		return m.Offset() == 3
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(2), localLog.HighWatermark())
+	record, err := localLog.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("orders-2"), record.Value)
+	require.Equal(t, "", record.Origin)
+	require.Equal(t, "remote", record.Cluster)
+
+	// the consumers of the remote cluster find where to resume in the local cluster
+	off, ok := m.Translate(1)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), off)
+	_, ok = m.Translate(3)
+	require.False(t, ok)
+	require.NoError(t, m.Close())
+
+	// a restarted mirror resumes from its checkpoint
+	produce("orders-3")
+	m, err = New(mirrorConfig)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return m.Offset() == 4
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(3), localLog.HighWatermark())
+	off, ok = m.Translate(0)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), off)
+	off, ok = m.Translate(3)
+	require.True(t, ok)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, m.Close())
+
+	// a crash losing the checkpoint doesn't mirror the records of the translation table again,
+	// and drops the entry it left partly written
+	checkpoints, err := log.NewCheckpoints(dir)
+	require.NoError(t, err)
+	checkpoints.Set(remoteCheckpoint, 1, nil)
+	require.NoError(t, checkpoints.Flush(0, func() error { return nil }))
+	f, err := os.OpenFile(filepath.Join(dir, translationsFile), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, translationWidth+4))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	m, err = New(mirrorConfig)
+	require.NoError(t, err)
+	defer m.Close()
+	require.Equal(t, uint64(4), m.Offset())
+	require.Len(t, m.table.entries, 3)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, uint64(3), localLog.HighWatermark())
+
+	// the records the remote cluster mirrored from the local one aren't mirrored back
+	_, err = remoteLog.Append(&api.Record{Value: []byte("orders-4"), Cluster: "local"})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return m.Offset() == 5
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(3), localLog.HighWatermark())
+}
+
+// setupCluster serves a log on a single server, returning its address
+func setupCluster(t *testing.T) (string, *log.Log, func()) {
+	t.Helper()
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "mirror-cluster-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog, Authorizer: authorizer},
+		grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	return ln.Addr().String(), clog, func() {
+		srv.Stop()
+		_ = clog.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,112 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// translationsFile is the name of the file holding the offset translation table of a mirror
+const translationsFile = "translations"
+
+// translationWidth is the width of an entry of the translation table, the remote and the local
+// offsets of a record
+const translationWidth = 16
+
+var enc = binary.BigEndian
+
+type translation struct {
+	remote, local uint64
+}
+
+// translationTable maps the offsets of the mirrored records in the remote cluster's log to their
+// offsets in the local cluster's log. The entries are appended to its file as the records are
+// mirrored, in the order of their remote offsets.
+type translationTable struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries []translation
+}
+
+// openTranslationTable loads the translation table kept in the file. The entries past the
+// mirror's checkpoint are kept, since their records were produced to the local cluster, up to
+// the first entry that doesn't follow the previous one, which a crash left partly written.
+func openTranslationTable(path string) (*translationTable, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	t := &translationTable{}
+	for i := 0; i+translationWidth <= len(b); i += translationWidth {
+		e := translation{remote: enc.Uint64(b[i:]), local: enc.Uint64(b[i+8:])}
+		if n := len(t.entries); n > 0 && e.remote <= t.entries[n-1].remote {
+			break
+		}
+		t.entries = append(t.entries, e)
+	}
+
+	t.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// a partly written entry is dropped along with the ones following it
+	if err = t.file.Truncate(int64(len(t.entries) * translationWidth)); err != nil {
+		_ = t.file.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// add records that the record at the remote offset was mirrored at the local offset
+func (t *translationTable) add(remote, local uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := make([]byte, translationWidth)
+	enc.PutUint64(b, remote)
+	enc.PutUint64(b[8:], local)
+	if _, err := t.file.Write(b); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, translation{remote: remote, local: local})
+	return nil
+}
+
+// next returns the remote offset following the last entry, and false when the table is empty
+func (t *translationTable) next() (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.entries) == 0 {
+		return 0, false
+	}
+	return t.entries[len(t.entries)-1].remote + 1, true
+}
+
+// sync flushes the table's entries to stable storage
+func (t *translationTable) sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file.Sync()
+}
+
+// translate returns the local offset of the first record mirrored from the remote offset on
+func (t *translationTable) translate(remote uint64) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].remote >= remote
+	})
+	if i == len(t.entries) {
+		return 0, false
+	}
+	return t.entries[i].local, true
+}
+
+func (t *translationTable) close() error {
+	return t.file.Close()
+}
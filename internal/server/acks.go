@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAckTimeout is how long ACKS_ALL produce requests wait for the replicas by default
+	defaultAckTimeout = 5 * time.Second
+	// defaultInSyncLagWindow is how long a replica stays in sync by default after it was
+	// last caught up with the log
+	defaultInSyncLagWindow = 10 * time.Second
+	// replicaExpiryWindows is the number of lag windows after which the replicas that stopped
+	// reporting their progress are no longer tracked
+	replicaExpiryWindows = 3
+)
+
+// replica is how far a replica copied the log, and the end of the log when it reported it. It
+// also holds when the replica was last caught up with the log, and when it last reported.
+type replica struct {
+	offset   uint64
+	end      uint64
+	caughtUp time.Time
+	seen     time.Time
+	inSync   bool
+	observer bool
+}
+
+// replicaTracker tracks how far each replica copied the log, as reported by the replicas,
+// so that produce requests can wait for the replicas to copy their record.
+//
+// It also maintains the in-sync replicas, the ones that were caught up with the log within
+// the lag window. A replica is caught up when it copied the records the log held when it last
+// reported, so that a replica fetching a steady stream of records, always a batch behind,
+// stays in sync. A replica that doesn't copy the new records in time, or stops reporting,
+// leaves the set, and rejoins it once it catches up again. The replicas that stopped reporting
+// for replicaExpiryWindows lag windows are no longer tracked.
+//
+// Observer replicas are tracked like the others, but neither acknowledge records nor count
+// as in-sync replicas.
+type replicaTracker struct {
+	mu        sync.Mutex
+	replicas  map[string]*replica
+	lagWindow time.Duration
+	// logEnd returns the offset following the highest record of the log
+	logEnd func() (uint64, bool)
+	// changed is closed and replaced whenever a replica reports its progress
+	changed chan struct{}
+	logger  *zap.Logger
+}
+
+func newReplicaTracker(lagWindow time.Duration, logEnd func() (uint64, bool)) *replicaTracker {
+	if lagWindow == 0 {
+		lagWindow = defaultInSyncLagWindow
+	}
+	return &replicaTracker{
+		replicas:  make(map[string]*replica),
+		lagWindow: lagWindow,
+		logEnd:    logEnd,
+		changed:   make(chan struct{}),
+		logger:    zap.L().Named("replicas"),
+	}
+}
+
+// ack records that the replica copied the log up to the offset, excluded
+func (t *replicaTracker) ack(name string, offset uint64, observer bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	end, ok := t.logEnd()
+	r, found := t.replicas[name]
+	if !found {
+		// a new replica is only caught up once it copied the whole log
+		r = &replica{end: end}
+		t.replicas[name] = r
+	}
+	r.seen = now
+	r.observer = observer
+	if offset > r.offset {
+		r.offset = offset
+	}
+	if !ok || r.offset >= r.end {
+		r.caughtUp = now
+	}
+	r.end = end
+
+	t.update()
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// update re-evaluates which replicas are in sync, logging the ones joining or leaving the set,
+// and stops tracking the ones that stopped reporting
+func (t *replicaTracker) update() {
+	end, ok := t.logEnd()
+	now := time.Now()
+	for name, r := range t.replicas {
+		idle := now.Sub(r.seen)
+		if idle > replicaExpiryWindows*t.lagWindow {
+			t.logger.Info("replica stopped reporting, no longer tracking it", zap.String("replica", name))
+			delete(t.replicas, name)
+			continue
+		}
+		if (!ok || r.offset >= end) && idle <= t.lagWindow {
+			r.caughtUp = now
+		}
+		inSync := now.Sub(r.caughtUp) <= t.lagWindow && idle <= t.lagWindow
+		if inSync != r.inSync {
+			if inSync {
+				t.logger.Info("replica caught up, expanding the in-sync replicas", zap.String("replica", name))
+			} else {
+				t.logger.Info("replica fell behind, shrinking the in-sync replicas",
+					zap.String("replica", name), zap.Uint64("offset", r.offset), zap.Uint64("log_end", end))
+			}
+			r.inSync = inSync
+		}
+	}
+}
+
+// states returns the state of each replica, sorted by name
+func (t *replicaTracker) states() []*api.ReplicaState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.update()
+	states := make([]*api.ReplicaState, 0, len(t.replicas))
+	for name, r := range t.replicas {
+		states = append(states, &api.ReplicaState{Name: name, Offset: r.offset, InSync: r.inSync, Observer: r.observer})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// inSync returns the number of in-sync replicas
+func (t *replicaTracker) inSync() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.update()
+	n := 0
+	for _, r := range t.replicas {
+		if r.inSync && !r.observer {
+			n++
+		}
+	}
+	return n
+}
+
+// acked returns the number of replicas that copied the record at the offset, whether all the
+// in-sync replicas did, and a channel closed when that may have changed
+func (t *replicaTracker) acked(offset uint64) (int, bool, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.update()
+	n, all := 0, true
+	for _, r := range t.replicas {
+		if r.observer {
+			continue
+		}
+		if r.offset > offset {
+			n++
+		} else if r.inSync {
+			all = false
+		}
+	}
+	return n, all, t.changed
+}
+
+// wait blocks until the in-sync replicas, and at least the required number of replicas,
+// copied the record at the offset. It returns ErrReplicationTimeout if they don't within
+// the timeout.
+func (t *replicaTracker) wait(ctx context.Context, offset uint64, required int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	// the in-sync replicas that don't copy the record leave the set once their lag window
+	// is over, which isn't signalled by changed
+	ticker := time.NewTicker(t.lagWindow / 10)
+	defer ticker.Stop()
+
+	for {
+		n, all, changed := t.acked(offset)
+		if n >= required && all {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-timer.C:
+			return api.ErrReplicationTimeout{Offset: offset, Acked: n, Required: required}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// asyncQueueSize is the number of ACKS_NONE records queued to be appended, past which the
+// records are dropped
+const asyncQueueSize = 1024
+
+// asyncAppender appends the records of the ACKS_NONE produce requests in the order they came
+// in, with a single goroutine started with the first of them and stopped with the server
+type asyncAppender struct {
+	mu      sync.Mutex
+	records chan *api.Record
+	done    chan struct{}
+	closed  bool
+	logger  *zap.Logger
+}
+
+// appendAsync queues the record of an ACKS_NONE produce request to be appended. The request
+// doesn't wait for the record, so the record is dropped when the queue is full rather than
+// holding the request up. It returns an error once the server is stopping.
+func (srv *grpcServer) appendAsync(record *api.Record) error {
+	a := &srv.async
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return status.Error(codes.Unavailable, "the server is stopping")
+	}
+	if a.records == nil {
+		a.records = make(chan *api.Record, asyncQueueSize)
+		a.done = make(chan struct{})
+		a.logger = zap.L().Named("server")
+		go srv.appendQueued()
+	}
+
+	select {
+	case a.records <- record:
+	default:
+		a.logger.Warn("dropped an unacknowledged record, the queue is full", zap.Int("queue_size", asyncQueueSize))
+	}
+	return nil
+}
+
+// appendQueued appends the queued records until the queue is closed
+func (srv *grpcServer) appendQueued() {
+	defer close(srv.async.done)
+	for record := range srv.async.records {
+		if _, err := srv.CommitLog.Append(record); err != nil {
+			srv.async.logger.Error("failed to append unacknowledged record", zap.Error(err))
+		}
+	}
+}
+
+// close stops queueing records, and waits for the queued ones to be appended
+func (a *asyncAppender) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	started := a.records != nil
+	if started {
+		close(a.records)
+	}
+	a.mu.Unlock()
+
+	if started {
+		<-a.done
+	}
+}
+
+// checkInSyncReplicas refuses ACKS_ALL produce requests while fewer replicas than the
+// configured minimum are in sync
+func (srv *grpcServer) checkInSyncReplicas() error {
+	if srv.MinInSyncReplicas == 0 {
+		return nil
+	}
+	if n := srv.replicas.inSync(); n < srv.MinInSyncReplicas {
+		return api.ErrNotEnoughReplicas{InSync: n, Required: srv.MinInSyncReplicas}
+	}
+	return nil
+}
+
+// waitForReplicas waits until enough replicas copied the record at the offset
+func (srv *grpcServer) waitForReplicas(ctx context.Context, offset uint64) error {
+	// a commit log that replicates records before its Append returns, such as Raft,
+	// has no replicas to wait for
+	if srv.AckReplicas == 0 {
+		return nil
+	}
+	timeout := srv.AckTimeout
+	if timeout == 0 {
+		timeout = defaultAckTimeout
+	}
+	return srv.replicas.wait(ctx, offset, srv.AckReplicas, timeout)
+}
+
+// logEnd returns the offset following the highest record of the commit log, if it can tell
+func (srv *grpcServer) logEnd() (uint64, bool) {
+	r, ok := srv.CommitLog.(HighWatermarkReporter)
+	if !ok {
+		return 0, false
+	}
+	return r.HighWatermark(), true
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	api "github.com/pandulaDW/go-distributed-service/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
+)
+
+// LeaderLocator is implemented by commit logs appending through a leader, such as the logs
+// replicated with Raft, so that the followers can forward their produce requests to it
+type LeaderLocator interface {
+	// Leader returns the gRPC address of the current leader, empty while none is elected, and
+	// whether this server is the leader
+	Leader() (string, bool)
+}
+
+// forwardedKey is the metadata key marking the requests forwarded to the leader, which aren't
+// forwarded again: two followers each taking the other for the leader would otherwise bounce a
+// request between them until its deadline
+const forwardedKey = "x-forwarded"
+
+// forwarder keeps the connection the produce requests are forwarded to the leader over, which
+// is shared by the requests and replaced when another server becomes the leader. A replaced
+// connection is closed once the requests forwarded over it are done.
+type forwarder struct {
+	mu   sync.Mutex
+	conn *leaderConn
+}
+
+// leaderConn is a connection to a leader, with the number of requests forwarded over it
+type leaderConn struct {
+	addr     string
+	conn     *grpc.ClientConn
+	refs     int
+	replaced bool
+}
+
+// client returns a client of the server at addr, dialing it unless it's the current one, and
+// the func releasing the connection once the request is forwarded
+func (f *forwarder) client(addr string, opts []grpc.DialOption) (api.LogClient, func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conn == nil || f.conn.addr != addr {
+		conn, err := grpc.Dial(addr, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		f.replace(&leaderConn{addr: addr, conn: conn})
+	}
+	c := f.conn
+	c.refs++
+	return api.NewLogClient(c.conn), func() { f.release(c) }, nil
+}
+
+// replace makes c the current connection, closing the previous one unless it's still in use
+func (f *forwarder) replace(c *leaderConn) {
+	if old := f.conn; old != nil {
+		old.replaced = true
+		if old.refs == 0 {
+			_ = old.conn.Close()
+		}
+	}
+	f.conn = c
+}
+
+func (f *forwarder) release(c *leaderConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c.refs--
+	if c.replaced && c.refs == 0 {
+		_ = c.conn.Close()
+	}
+}
+
+// close closes the connection to the leader, if any, once the requests forwarded over it are done
+func (f *forwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.replace(nil)
+}
+
+// leader returns a client of the leader to forward the produce requests to, with the func
+// releasing it, or nil if the server appends the records itself. With RedirectWrites, the
+// followers return api.ErrNotLeader instead, and the observers always return api.ErrObserver.
+// A request that was already forwarded isn't forwarded again.
+func (srv *grpcServer) leader(ctx context.Context) (api.LogClient, func(), error) {
+	if srv.Observer {
+		return nil, nil, api.ErrObserver{}
+	}
+	locator, ok := srv.CommitLog.(LeaderLocator)
+	if !ok {
+		return nil, nil, nil
+	}
+	addr, isLeader := locator.Leader()
+	if isLeader {
+		return nil, nil, nil
+	}
+	if addr == "" {
+		return nil, nil, status.Error(codes.Unavailable, "no leader is elected")
+	}
+	if srv.RedirectWrites {
+		return nil, nil, api.ErrNotLeader{LeaderAddr: addr}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(forwardedKey)) > 0 {
+		return nil, nil, status.Errorf(codes.Unavailable, "forwarded to a follower, the leader is %s", addr)
+	}
+	return srv.forward.client(addr, srv.ForwardDialOptions)
+}
+
+// forwarded returns the context of a request forwarded to the leader, which marks it as such
+func forwarded(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, forwardedKey, "true")
+}
+
+// forwardBulkRecords streams the records of a ProduceBulkRecords request to the leader, and
+// relays its response
+func forwardBulkRecords(stream api.Log_ProduceBulkRecordsServer, leader api.LogClient) error {
+	out, err := leader.ProduceBulkRecords(forwarded(stream.Context()))
+	if err != nil {
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = out.Send(req); err != nil {
+			// the leader ended the stream, and its status tells why
+			if _, recvErr := out.CloseAndRecv(); recvErr != nil {
+				return recvErr
+			}
+			return err
+		}
+	}
+
+	res, err := out.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(res)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const (
+	// logService is the health check service name covering the whole Log service
+	logService = "Log"
+	// produceService is the health check service name covering writes to the log only
+	produceService = "Log.Produce"
+)
+
+// healthWatchInterval is how often Watch re-checks the serving status
+var healthWatchInterval = time.Second
+
+// ReadOnlyReporter is implemented by commit logs that can degrade into a read-only
+// mode, such as when they run out of disk space.
+type ReadOnlyReporter interface {
+	ReadOnly() bool
+}
+
+// healthServer implements the gRPC health checking protocol for the log service.
+//
+// The server and the Log service are serving as long as the process is up, since reads are
+// always served, while Log.Produce stops serving when the commit log is in read-only mode.
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	*Config
+}
+
+// Check returns the current serving status of the given service
+func (h *healthServer) Check(_ context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	st, err := h.status(req.Service)
+	if err != nil {
+		return nil, err
+	}
+	return &healthpb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch streams the serving status of the given service, sending an update whenever it changes
+func (h *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	var last healthpb.HealthCheckResponse_ServingStatus = -1
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		st, err := h.status(req.Service)
+		if err != nil {
+			st = healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+		}
+		if st != last {
+			if err = stream.Send(&healthpb.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return status.Error(codes.Canceled, "stream has ended")
+		case <-ticker.C:
+		}
+	}
+}
+
+// status resolves the serving status of the given service name
+func (h *healthServer) status(service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	switch service {
+	case "", logService:
+		return healthpb.HealthCheckResponse_SERVING, nil
+	case produceService:
+		if r, ok := h.CommitLog.(ReadOnlyReporter); ok && r.ReadOnly() {
+			return healthpb.HealthCheckResponse_NOT_SERVING, nil
+		}
+		return healthpb.HealthCheckResponse_SERVING, nil
+	default:
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, status.Error(codes.NotFound, "unknown service")
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"github.com/pandulaDW/go-distributed-service/internal/log"
+	"github.com/stretchr/testify/require"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+	commitLog := &readOnlyLog{}
+	h := &healthServer{Config: &Config{CommitLog: commitLog}}
+
+	for _, service := range []string{"", logService, produceService} {
+		res, err := h.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+	}
+
+	// reads keep being served while writes are rejected
+	commitLog.readOnly = true
+	res, err := h.Check(ctx, &healthpb.HealthCheckRequest{Service: logService})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	res, err = h.Check(ctx, &healthpb.HealthCheckRequest{Service: produceService})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+
+	_, err = h.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	require.Error(t, err)
+}
+
+type readOnlyLog struct {
+	log.Log
+	readOnly bool
+}
+
+func (l *readOnlyLog) ReadOnly() bool {
+	return l.readOnly
+}
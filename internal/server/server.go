@@ -15,8 +15,10 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"io"
 	"strings"
 	"time"
@@ -27,25 +29,124 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
+// HighWatermarkReporter is implemented by commit logs that can tell the offset following
+// their highest record, which ConsumeStream sends along with the records so that consumers
+// know their lag.
+type HighWatermarkReporter interface {
+	HighWatermark() uint64
+}
+
+// SegmentShipper is implemented by commit logs that can ship the raw files of their sealed
+// segments, which FetchSegments streams to the replicas bootstrapping from the server
+type SegmentShipper interface {
+	ShipSegments(offset uint64, send func(*api.SegmentChunk) error) error
+}
+
+// DigestReporter is implemented by commit logs that can digest their records by origin, which
+// GetDigests and ReadOriginRange serve to the replicas verifying that they hold the same records
+type DigestReporter interface {
+	Digests(rangeSize uint64) ([]*api.OriginDigest, error)
+	ReadOrigin(origin string, start, end uint64) ([]*api.Record, error)
+}
+
+// ReplicationReporter reports how far the server is in replicating its peers' logs
+type ReplicationReporter interface {
+	ReplicationStatus() []*api.PeerReplicationStatus
+}
+
+// ServerGetter lists the servers of the cluster, which GetServers returns to the clients
+// discovering the cluster
+type ServerGetter interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// OffsetSharer is implemented by the server getters of clusters whose servers hold the records
+// at the same offsets, such as the clusters replicating with Raft, so that GetServers tells the
+// clients they can read from any server
+type OffsetSharer interface {
+	SharedOffsets() bool
+}
+
+// ReplicationThrottler is implemented by the replication reporters that limit the rate they
+// copy the peers' logs at, which SetReplicationThrottle replaces at runtime
+type ReplicationThrottler interface {
+	Throttle() *api.ReplicationThrottle
+	SetThrottle(*api.ReplicationThrottle)
+}
+
+// Config configures the server. AckReplicas is the number of replicas that must copy a record
+// before an ACKS_ALL produce request is acknowledged, and AckTimeout how long the request waits
+// for them, 5 seconds by default. With AckReplicas set to 0, ACKS_ALL requests are
+// acknowledged like ACKS_LEADER ones, which suits commit logs replicating records before
+// their Append returns.
+//
+// A replica is in sync while it was caught up with the log within InSyncLagWindow, 10 seconds
+// by default. ACKS_ALL produce requests also wait for every in-sync replica, and are refused
+// while fewer than MinInSyncReplicas replicas are in sync.
+//
+// Followers of a commit log appending through a leader, a LeaderLocator, forward the produce
+// requests to the leader with ForwardDialOptions and relay its response. The forwarded requests
+// are authorized by the leader as the identity of these options, and refused by a follower they
+// reach instead of being forwarded again. With RedirectWrites, the followers return
+// api.ErrNotLeader, holding the leader's address, instead.
+//
+// ServerGetter lists the servers of the cluster for GetServers, which is unimplemented without it.
+//
+// An Observer server is a read-only replica, which refuses the produce requests with
+// api.ErrObserver and only serves the reads.
 type Config struct {
-	CommitLog  CommitLog
-	Authorizer Authorizer
+	CommitLog          CommitLog
+	Authorizer         Authorizer
+	Replication        ReplicationReporter
+	AckReplicas        int
+	AckTimeout         time.Duration
+	MinInSyncReplicas  int
+	InSyncLagWindow    time.Duration
+	ForwardDialOptions []grpc.DialOption
+	RedirectWrites     bool
+	Observer           bool
+	ServerGetter       ServerGetter
 }
 
 const (
-	objectWildcard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	objectWildcard  = "*"
+	produceAction   = "produce"
+	consumeAction   = "consume"
+	replicateAction = "replicate"
+	adminAction     = "admin"
 )
 
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	replicas *replicaTracker
+	async    asyncAppender
+	forward  forwarder
+}
+
+// Server is the gRPC server the log service is registered to. Stopping it also stops the
+// service, appending the queued ACKS_NONE records, so it must be stopped before the commit
+// log is closed.
+type Server struct {
+	*grpc.Server
+	service *grpcServer
+}
+
+// Stop stops the gRPC server, and then the service
+func (s *Server) Stop() {
+	s.Server.Stop()
+	s.service.close()
+}
+
+// GracefulStop stops the gRPC server once the pending requests are done, and then the service
+func (s *Server) GracefulStop() {
+	s.Server.GracefulStop()
+	s.service.close()
 }
 
 // NewGRPCServer instantiate the log service, create a gRPC server, and register the
 // service to that server
-func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*Server, error) {
 	// set logger options
 	logger := zap.L().Named("server")
 	zapOpts := []grpcZap.Option{
@@ -86,25 +187,62 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
-	return gsrv, nil
+	healthpb.RegisterHealthServer(gsrv, &healthServer{Config: config})
+	return &Server{Server: gsrv, service: srv}, nil
 }
 
 // newgrpcServer creates a new server instance
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 	srv = &grpcServer{Config: config}
+	srv.replicas = newReplicaTracker(config.InSyncLagWindow, srv.logEnd)
 	return srv, nil
 }
 
+// close releases what the service holds once the gRPC server stopped
+func (srv *grpcServer) close() {
+	srv.async.close()
+	srv.forward.close()
+}
+
 // Produce implements the Produce handler
 func (srv *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
 	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction)
 	if err != nil {
 		return nil, err
 	}
+
+	leader, release, err := srv.leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		defer release()
+		return leader.Produce(forwarded(ctx), req)
+	}
+
+	// fire-and-forget records are acknowledged before they get an offset
+	if req.Acks == api.Acks_ACKS_NONE {
+		if err = srv.appendAsync(req.Record); err != nil {
+			return nil, err
+		}
+		return &api.ProduceResponse{}, nil
+	}
+
+	if req.Acks == api.Acks_ACKS_ALL {
+		if err = srv.checkInSyncReplicas(); err != nil {
+			return nil, err
+		}
+	}
+
 	off, err := srv.CommitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
 	}
+	if req.Acks == api.Acks_ACKS_ALL {
+		if err = srv.waitForReplicas(ctx, off); err != nil {
+			return nil, err
+		}
+	}
 	return &api.ProduceResponse{Offset: off}, nil
 }
 
@@ -122,7 +260,8 @@ func (srv *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*a
 }
 
 // ProduceStream implements a bidirectional streaming RPC so the client can stream data into the server’s
-// log and the server can tell the client whether each request succeeded
+// log and the server can tell the client whether each request succeeded. Like Produce, followers
+// forward each request to the leader.
 func (srv *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -160,6 +299,7 @@ func (srv *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Con
 			default:
 				return err
 			}
+			res.HighWatermark, _ = srv.logEnd()
 			if err = stream.Send(res); err != nil {
 				return err
 			}
@@ -168,10 +308,160 @@ func (srv *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Con
 	}
 }
 
+// Defaults of the fetch requests leaving their limits unset
+const (
+	defaultFetchRecords = 100
+	defaultFetchBytes   = 1 << 20
+	defaultFetchWait    = 500 * time.Millisecond
+	fetchPollInterval   = 10 * time.Millisecond
+)
+
+// Fetch implements the handler the replicas copy the log with. It returns the records from the
+// requested offset on, up to the requested number of records and bytes, waiting for records to
+// be appended when there are none yet.
+//
+// The first record is returned even when it's larger than the requested bytes, so that the
+// replica always makes progress.
+func (srv *grpcServer) Fetch(ctx context.Context, req *api.FetchRequest) (*api.FetchResponse, error) {
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, replicateAction)
+	if err != nil {
+		return nil, err
+	}
+	if req.Replica != "" {
+		srv.replicas.ack(req.Replica, req.Offset, req.Observer)
+	}
+
+	maxRecords, maxBytes, maxWait := int(req.MaxRecords), int(req.MaxBytes), time.Duration(req.MaxWaitMs)*time.Millisecond
+	if maxRecords == 0 {
+		maxRecords = defaultFetchRecords
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultFetchBytes
+	}
+	if maxWait == 0 {
+		maxWait = defaultFetchWait
+	}
+
+	res := &api.FetchResponse{}
+	deadline := time.Now().Add(maxWait)
+	for {
+		size := 0
+		for off := req.Offset; len(res.Records) < maxRecords; off++ {
+			record, err := srv.CommitLog.Read(off)
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			size += proto.Size(record)
+			if len(res.Records) > 0 && size > maxBytes {
+				break
+			}
+			res.Records = append(res.Records, record)
+		}
+
+		if len(res.Records) > 0 || !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(fetchPollInterval):
+		}
+	}
+
+	res.HighWatermark, _ = srv.logEnd()
+	return res, nil
+}
+
+// FetchSegments streams the files of the commit log's sealed segments holding records from the
+// requested offset on, so that a new replica copies them at disk speed before fetching the rest
+// of the log record by record. It's unimplemented for commit logs that can't ship their segments.
+func (srv *grpcServer) FetchSegments(req *api.FetchSegmentsRequest, stream api.Log_FetchSegmentsServer) error {
+	err := srv.Authorizer.Authorize(subject(stream.Context()), objectWildcard, replicateAction)
+	if err != nil {
+		return err
+	}
+
+	shipper, ok := srv.CommitLog.(SegmentShipper)
+	if !ok {
+		return status.Error(codes.Unimplemented, "the commit log can't ship its segments")
+	}
+	return shipper.ShipSegments(req.Offset, stream.Send)
+}
+
+// defaultDigestRangeSize is the number of origin offsets GetDigests digests together by default
+const defaultDigestRangeSize = 1024
+
+// GetDigests returns the digests of the commit log's records, by origin and range of origin
+// offsets, for a replica to compare with its own
+func (srv *grpcServer) GetDigests(ctx context.Context, req *api.GetDigestsRequest) (*api.GetDigestsResponse, error) {
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, replicateAction)
+	if err != nil {
+		return nil, err
+	}
+
+	reporter, ok := srv.CommitLog.(DigestReporter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "the commit log can't digest its records")
+	}
+	rangeSize := req.RangeSize
+	if rangeSize == 0 {
+		rangeSize = defaultDigestRangeSize
+	}
+	origins, err := reporter.Digests(rangeSize)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetDigestsResponse{Origins: origins}, nil
+}
+
+// ReadOriginRange returns the records of an origin in a range of origin offsets, for a replica
+// to repair the range from
+func (srv *grpcServer) ReadOriginRange(ctx context.Context, req *api.ReadOriginRangeRequest) (
+	*api.ReadOriginRangeResponse, error) {
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, replicateAction)
+	if err != nil {
+		return nil, err
+	}
+
+	reporter, ok := srv.CommitLog.(DigestReporter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "the commit log can't digest its records")
+	}
+	records, err := reporter.ReadOrigin(req.Origin, req.Start, req.End)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ReadOriginRangeResponse{Records: records}, nil
+}
+
 // ProduceBulkRecords implements a streaming RPC for client to bulk insert records to reduce the number
-// of connections maintained when inserting a large number of records at once.
+// of connections maintained when inserting a large number of records at once. Followers forward the
+// whole stream to the leader.
+//
+// The acknowledgement level of each request applies to its record as with Produce, except that
+// the ACKS_ALL records are all waited for once the stream ends, before the response is sent.
 func (srv *grpcServer) ProduceBulkRecords(stream api.Log_ProduceBulkRecordsServer) error {
+	err := srv.Authorizer.Authorize(subject(stream.Context()), objectWildcard, produceAction)
+	if err != nil {
+		return err
+	}
+
+	leader, release, err := srv.leader(stream.Context())
+	if err != nil {
+		return err
+	}
+	if leader != nil {
+		defer release()
+		return forwardBulkRecords(stream, leader)
+	}
+
 	insertCount := uint64(0)
+	// the replicas copy the log in order, so waiting for the last ACKS_ALL record covers the others
+	var waitFor uint64
+	wait := false
 
 loop:
 	for {
@@ -186,17 +476,118 @@ loop:
 			if err != nil {
 				return err
 			}
-			_, err = srv.CommitLog.Append(req.Record)
-			if err != nil {
-				return err
+
+			switch req.Acks {
+			case api.Acks_ACKS_NONE:
+				if err = srv.appendAsync(req.Record); err != nil {
+					return err
+				}
+			case api.Acks_ACKS_ALL:
+				if err = srv.checkInSyncReplicas(); err != nil {
+					return err
+				}
+				if waitFor, err = srv.CommitLog.Append(req.Record); err != nil {
+					return err
+				}
+				wait = true
+			default:
+				if _, err = srv.CommitLog.Append(req.Record); err != nil {
+					return err
+				}
 			}
 			insertCount++
 		}
 	}
 
+	if wait {
+		if err = srv.waitForReplicas(stream.Context(), waitFor); err != nil {
+			return err
+		}
+	}
 	return stream.SendAndClose(&api.ProduceBulkResponse{NumRecordsInserted: insertCount})
 }
 
+// GetReplicationStatus implements the admin handler reporting how far the server is in
+// replicating each of its peers
+func (srv *grpcServer) GetReplicationStatus(ctx context.Context, _ *api.GetReplicationStatusRequest) (
+	*api.GetReplicationStatusResponse, error) {
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction)
+	if err != nil {
+		return nil, err
+	}
+	res := &api.GetReplicationStatusResponse{}
+	if srv.Replication != nil {
+		res.Peers = srv.Replication.ReplicationStatus()
+	}
+	if throttler, ok := srv.Replication.(ReplicationThrottler); ok {
+		res.Throttle = throttler.Throttle()
+	}
+	return res, nil
+}
+
+// SetReplicationThrottle implements the admin handler replacing the rate limits the server
+// copies its peers' logs with
+func (srv *grpcServer) SetReplicationThrottle(ctx context.Context, req *api.SetReplicationThrottleRequest) (
+	*api.SetReplicationThrottleResponse, error) {
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction)
+	if err != nil {
+		return nil, err
+	}
+	throttler, ok := srv.Replication.(ReplicationThrottler)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "the server doesn't throttle its replication")
+	}
+	throttler.SetThrottle(req.Throttle)
+	return &api.SetReplicationThrottleResponse{}, nil
+}
+
+// AcknowledgeReplication implements the handler the replicas report how far they copied
+// the log to, which ACKS_ALL produce requests wait on
+func (srv *grpcServer) AcknowledgeReplication(ctx context.Context, req *api.AcknowledgeReplicationRequest) (
+	*api.AcknowledgeReplicationResponse, error) {
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, replicateAction)
+	if err != nil {
+		return nil, err
+	}
+	srv.replicas.ack(req.Replica, req.Offset, req.Observer)
+	return &api.AcknowledgeReplicationResponse{}, nil
+}
+
+// GetInSyncReplicas implements the admin handler reporting how far each replica copied the
+// log and whether it's in sync
+func (srv *grpcServer) GetInSyncReplicas(ctx context.Context, _ *api.GetInSyncReplicasRequest) (
+	*api.GetInSyncReplicasResponse, error) {
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetInSyncReplicasResponse{
+		Replicas:          srv.replicas.states(),
+		MinInSyncReplicas: uint32(srv.MinInSyncReplicas),
+	}, nil
+}
+
+// GetServers implements the handler the clients discover the servers of the cluster with, from
+// any of them. The clients allowed to consume the log can discover the cluster.
+func (srv *grpcServer) GetServers(ctx context.Context, _ *api.GetServersRequest) (*api.GetServersResponse, error) {
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction)
+	if err != nil {
+		return nil, err
+	}
+	if srv.ServerGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "the server doesn't know the cluster")
+	}
+	servers, err := srv.ServerGetter.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	res := &api.GetServersResponse{Servers: servers}
+	if sharer, ok := srv.ServerGetter.(OffsetSharer); ok {
+		res.SharedOffsets = sharer.SharedOffsets()
+	}
+	return res, nil
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
@@ -11,8 +11,11 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -230,6 +233,7 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, _ *Config)
 			res, err := stream.Recv()
 			require.NoError(t, err)
 			require.Equal(t, res.Record, &api.Record{Offset: uint64(i), Value: record.Value})
+			require.Equal(t, uint64(len(records)), res.HighWatermark)
 		}
 	}
 }
@@ -278,4 +282,491 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, _ *Config) {
 	if gotCode != wantCode {
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
+
+	bulk, err := client.ProduceBulkRecords(ctx)
+	require.NoError(t, err)
+	err = bulk.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	if err == nil || err == io.EOF {
+		_, err = bulk.CloseAndRecv()
+	}
+	gotCode, wantCode = status.Code(err), codes.PermissionDenied
+	if gotCode != wantCode {
+		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
+	}
+}
+
+type replicationReporter []*api.PeerReplicationStatus
+
+func (r replicationReporter) ReplicationStatus() []*api.PeerReplicationStatus {
+	return r
+}
+
+func TestReplicationStatus(t *testing.T) {
+	peers := replicationReporter{
+		{Name: "peer-1", Addr: "127.0.0.1:8401", State: "replicating", Connected: true, LagRecords: 3},
+	}
+	rootClient, nobodyClient, _, teardown := setupTest(t, func(config *Config) {
+		config.Replication = peers
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	res, err := rootClient.GetReplicationStatus(ctx, &api.GetReplicationStatusRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Peers, 1)
+	require.Equal(t, "peer-1", res.Peers[0].Name)
+	require.Equal(t, uint64(3), res.Peers[0].LagRecords)
+
+	_, err = nobodyClient.GetReplicationStatus(ctx, &api.GetReplicationStatusRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+type replicationThrottler struct {
+	replicationReporter
+	throttle *api.ReplicationThrottle
+}
+
+func (r *replicationThrottler) Throttle() *api.ReplicationThrottle {
+	return r.throttle
+}
+
+func (r *replicationThrottler) SetThrottle(throttle *api.ReplicationThrottle) {
+	r.throttle = throttle
+}
+
+func TestReplicationThrottle(t *testing.T) {
+	throttler := &replicationThrottler{throttle: &api.ReplicationThrottle{}}
+	rootClient, nobodyClient, cfg, teardown := setupTest(t, func(config *Config) {
+		config.Replication = throttler
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	throttle := &api.ReplicationThrottle{TotalBytesPerSecond: 1 << 20, PeerBytesPerSecond: 256 << 10}
+	_, err := rootClient.SetReplicationThrottle(ctx, &api.SetReplicationThrottleRequest{Throttle: throttle})
+	require.NoError(t, err)
+	res, err := rootClient.GetReplicationStatus(ctx, &api.GetReplicationStatusRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1<<20), res.Throttle.TotalBytesPerSecond)
+	require.Equal(t, uint64(256<<10), res.Throttle.PeerBytesPerSecond)
+
+	_, err = nobodyClient.SetReplicationThrottle(ctx, &api.SetReplicationThrottleRequest{Throttle: throttle})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// servers that don't replicate have no throttle to set
+	cfg.Replication = nil
+	_, err = rootClient.SetReplicationThrottle(ctx, &api.SetReplicationThrottleRequest{Throttle: throttle})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+type serverGetter []*api.Server
+
+func (g serverGetter) GetServers() ([]*api.Server, error) {
+	return g, nil
+}
+
+// raftServerGetter lists the servers of a cluster replicating with Raft
+type raftServerGetter struct {
+	serverGetter
+}
+
+func (g raftServerGetter) SharedOffsets() bool {
+	return true
+}
+
+func TestGetServers(t *testing.T) {
+	servers := serverGetter{
+		{Id: "0", RpcAddr: "127.0.0.1:8400", Role: api.ServerRole_ROLE_LEADER, Zone: "zone-0", Healthy: true},
+		{Id: "1", RpcAddr: "127.0.0.1:8401", Role: api.ServerRole_ROLE_OBSERVER, Zone: "zone-1", Healthy: false},
+	}
+	rootClient, nobodyClient, cfg, teardown := setupTest(t, func(config *Config) {
+		config.ServerGetter = servers
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	res, err := rootClient.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Servers, 2)
+	require.Equal(t, "127.0.0.1:8401", res.Servers[1].RpcAddr)
+	require.Equal(t, api.ServerRole_ROLE_OBSERVER, res.Servers[1].Role)
+	require.False(t, res.Servers[1].Healthy)
+	require.False(t, res.SharedOffsets)
+
+	// the clients are told when they can read from any server
+	cfg.ServerGetter = raftServerGetter{servers}
+	res, err = rootClient.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.True(t, res.SharedOffsets)
+
+	_, err = nobodyClient.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// a server that doesn't know the cluster can't tell its servers
+	cfg.ServerGetter = nil
+	_, err = rootClient.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestProduceAcks(t *testing.T) {
+	rootClient, _, cfg, teardown := setupTest(t, func(config *Config) {
+		config.AckReplicas = 1
+		config.AckTimeout = 200 * time.Millisecond
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// fire-and-forget records are appended after the response
+	res, err := rootClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("none")},
+		Acks:   api.Acks_ACKS_NONE,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+	require.Eventually(t, func() bool {
+		record, err := cfg.CommitLog.Read(0)
+		return err == nil && string(record.Value) == "none"
+	}, time.Second, 10*time.Millisecond)
+
+	// no replica copied the record in time
+	_, err = rootClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("all")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Contains(t, err.Error(), "replication timed out")
+
+	// the replica acknowledges the record while the request waits
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = rootClient.AcknowledgeReplication(ctx, &api.AcknowledgeReplicationRequest{
+			Replica: "replica-1",
+			Offset:  3,
+		})
+	}()
+	res, err = rootClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("all")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Offset)
+
+	// the bulk requests wait for their ACKS_ALL records too
+	bulk, err := rootClient.ProduceBulkRecords(ctx)
+	require.NoError(t, err)
+	for _, acks := range []api.Acks{api.Acks_ACKS_ALL, api.Acks_ACKS_LEADER} {
+		require.NoError(t, bulk.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("bulk")}, Acks: acks}))
+	}
+	_, err = bulk.CloseAndRecv()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// the queued records are appended when the service stops, after which none are queued
+	srv, err := newgrpcServer(cfg)
+	require.NoError(t, err)
+	require.NoError(t, srv.appendAsync(&api.Record{Value: []byte("queued")}))
+	srv.close()
+	record, err := cfg.CommitLog.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("queued"), record.Value)
+	err = srv.appendAsync(&api.Record{Value: []byte("stopped")})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestInSyncReplicas(t *testing.T) {
+	rootClient, _, _, teardown := setupTest(t, func(config *Config) {
+		config.AckReplicas = 1
+		config.AckTimeout = time.Second
+		config.MinInSyncReplicas = 1
+		config.InSyncLagWindow = 100 * time.Millisecond
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// no replica is in sync yet
+	produceAll := func() (*api.ProduceResponse, error) {
+		return rootClient.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("all")},
+			Acks:   api.Acks_ACKS_ALL,
+		})
+	}
+	_, err := produceAll()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = rootClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Error(t, err)
+
+	// a replica catching up with the log joins the in-sync replicas
+	_, err = rootClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("leader")}})
+	require.NoError(t, err)
+	for _, replica := range []string{"replica-1", "replica-2"} {
+		_, err = rootClient.AcknowledgeReplication(ctx, &api.AcknowledgeReplicationRequest{Replica: replica, Offset: 1})
+		require.NoError(t, err)
+	}
+	isr, err := rootClient.GetInSyncReplicas(ctx, &api.GetInSyncReplicasRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), isr.MinInSyncReplicas)
+	require.Equal(t, []*api.ReplicaState{
+		{Name: "replica-1", Offset: 1, InSync: true},
+		{Name: "replica-2", Offset: 1, InSync: true},
+	}, isr.Replicas)
+
+	// only replica-1 copies the next record, so replica-2 leaves the in-sync replicas
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = rootClient.AcknowledgeReplication(ctx, &api.AcknowledgeReplicationRequest{Replica: "replica-1", Offset: 2})
+	}()
+	res, err := produceAll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	isr, err = rootClient.GetInSyncReplicas(ctx, &api.GetInSyncReplicasRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []*api.ReplicaState{
+		{Name: "replica-1", Offset: 2, InSync: true},
+		{Name: "replica-2", Offset: 1, InSync: false},
+	}, isr.Replicas)
+}
+
+func TestReplicaTracker(t *testing.T) {
+	end := uint64(10)
+	tracker := newReplicaTracker(100*time.Millisecond, func() (uint64, bool) {
+		return end, true
+	})
+
+	// a new replica is only in sync once it copied the whole log
+	tracker.ack("replica-1", 5, false)
+	tracker.ack("replica-2", 10, false)
+	require.Equal(t, 1, tracker.inSync())
+
+	// a replica copying a steady stream of records a batch behind the log stays in sync
+	for i := 0; i < 5; i++ {
+		end += 5
+		tracker.ack("replica-2", end-5, false)
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.Equal(t, 1, tracker.inSync())
+
+	// a replica that stops reporting leaves the set, and is then no longer tracked
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, 0, tracker.inSync())
+	require.Len(t, tracker.states(), 2)
+	time.Sleep(200 * time.Millisecond)
+	require.Empty(t, tracker.states())
+}
+
+func TestObservers(t *testing.T) {
+	rootClient, _, cfg, teardown := setupTest(t, func(config *Config) {
+		config.AckReplicas = 1
+		config.AckTimeout = 100 * time.Millisecond
+		config.MinInSyncReplicas = 1
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// an observer copying the whole log neither acknowledges the records nor is in sync
+	_, err := rootClient.Fetch(ctx, &api.FetchRequest{Offset: 1, Replica: "observer-1", Observer: true})
+	require.NoError(t, err)
+	isr, err := rootClient.GetInSyncReplicas(ctx, &api.GetInSyncReplicasRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []*api.ReplicaState{
+		{Name: "observer-1", Offset: 1, InSync: true, Observer: true},
+	}, isr.Replicas)
+	_, err = rootClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("all")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// and an observer server refuses the produce requests, while serving the reads
+	_, err = cfg.CommitLog.Append(&api.Record{Value: []byte("copied")})
+	require.NoError(t, err)
+	cfg.Observer = true
+	_, err = rootClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("refused")}})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Equal(t, api.ErrObserver{}.Error(), err.Error())
+	consume, err := rootClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("copied"), consume.Record.Value)
+}
+
+func TestFetch(t *testing.T) {
+	rootClient, nobodyClient, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := rootClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+
+	// the batch stops at max_records
+	res, err := rootClient.Fetch(ctx, &api.FetchRequest{Offset: 0, Replica: "replica-1", MaxRecords: 2})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Equal(t, uint64(1), res.Records[1].Offset)
+	require.Equal(t, uint64(3), res.HighWatermark)
+
+	// the batch stops at max_bytes, but holds at least one record
+	res, err = rootClient.Fetch(ctx, &api.FetchRequest{Offset: 1, Replica: "replica-1", MaxBytes: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(1), res.Records[0].Offset)
+
+	// fetching from an offset acknowledges the records before it
+	isr, err := rootClient.GetInSyncReplicas(ctx, &api.GetInSyncReplicasRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []*api.ReplicaState{{Name: "replica-1", Offset: 1, InSync: false}}, isr.Replicas)
+
+	// the fetch waits for a record produced past the end of the log
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = rootClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("late")}})
+	}()
+	res, err = rootClient.Fetch(ctx, &api.FetchRequest{Offset: 3, Replica: "replica-1", MaxWaitMs: 1000})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, []byte("late"), res.Records[0].Value)
+
+	// an empty batch once the wait is over
+	res, err = rootClient.Fetch(ctx, &api.FetchRequest{Offset: 4, Replica: "replica-1", MaxWaitMs: 10})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+	require.Equal(t, uint64(4), res.HighWatermark)
+
+	_, err = nobodyClient.Fetch(ctx, &api.FetchRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestFetchSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetch-segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+
+	rootClient, nobodyClient, _, teardown := setupTest(t, func(config *Config) {
+		config.CommitLog = clog
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// fill the first segment of the log
+	for i := 0; i < 3; i++ {
+		_, err := rootClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+
+	stream, err := rootClient.FetchSegments(ctx, &api.FetchSegmentsRequest{})
+	require.NoError(t, err)
+	var chunks []*api.SegmentChunk
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	require.Equal(t, api.SegmentFile_SEGMENT_STORE, chunks[0].File)
+	last := chunks[len(chunks)-1]
+	require.True(t, last.Last)
+	require.Equal(t, uint64(0), last.BaseOffset)
+	require.NotZero(t, last.NextOffset)
+
+	stream, err = nobodyClient.FetchSegments(ctx, &api.FetchSegmentsRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestGetDigests(t *testing.T) {
+	rootClient, nobodyClient, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := rootClient.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world"), Origin: "origin", OriginOffset: uint64(i)},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := rootClient.GetDigests(ctx, &api.GetDigestsRequest{RangeSize: 2})
+	require.NoError(t, err)
+	require.Len(t, res.Origins, 1)
+	require.Equal(t, "origin", res.Origins[0].Origin)
+	require.Equal(t, uint64(3), res.Origins[0].NextOffset)
+	require.Len(t, res.Origins[0].Ranges, 2)
+
+	records, err := rootClient.ReadOriginRange(ctx, &api.ReadOriginRangeRequest{Origin: "origin", Start: 1, End: 3})
+	require.NoError(t, err)
+	require.Len(t, records.Records, 2)
+	require.Equal(t, uint64(1), records.Records[0].OriginOffset)
+
+	_, err = nobodyClient.GetDigests(ctx, &api.GetDigestsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestForwarderClose(t *testing.T) {
+	var f forwarder
+	_, release, err := f.client("127.0.0.1:0", []grpc.DialOption{grpc.WithInsecure()})
+	require.NoError(t, err)
+	conn := f.conn.conn
+	release()
+
+	f.close()
+	require.Nil(t, f.conn)
+	require.Equal(t, connectivity.Shutdown, conn.GetState())
+}
+
+func TestForwarderReplace(t *testing.T) {
+	var f forwarder
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	_, release, err := f.client("127.0.0.1:1", opts)
+	require.NoError(t, err)
+	old := f.conn.conn
+
+	// the connection to the previous leader stays open while a request is forwarded over it
+	_, releaseNew, err := f.client("127.0.0.1:2", opts)
+	require.NoError(t, err)
+	require.NotEqual(t, connectivity.Shutdown, old.GetState())
+	release()
+	require.Equal(t, connectivity.Shutdown, old.GetState())
+
+	current := f.conn.conn
+	f.close()
+	require.NotEqual(t, connectivity.Shutdown, current.GetState())
+	releaseNew()
+	require.Equal(t, connectivity.Shutdown, current.GetState())
+}
+
+// followerLog is a commit log whose leader is another server
+type followerLog struct {
+	CommitLog
+	leaderAddr string
+}
+
+func (l followerLog) Leader() (string, bool) {
+	return l.leaderAddr, false
+}
+
+func TestForwardOnce(t *testing.T) {
+	srv := &grpcServer{Config: &Config{
+		CommitLog:          followerLog{leaderAddr: "127.0.0.1:1"},
+		ForwardDialOptions: []grpc.DialOption{grpc.WithInsecure()},
+	}}
+	defer srv.close()
+
+	leader, release, err := srv.leader(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, leader)
+	release()
+
+	// a follower the request was forwarded to refuses to forward it again
+	md, _ := metadata.FromOutgoingContext(forwarded(context.Background()))
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	_, _, err = srv.leader(ctx)
+	require.Equal(t, codes.Unavailable, status.Code(err))
 }
@@ -14,7 +14,7 @@ func main() {
 	listener, _ := net.Listen("tcp", ":50051")
 	isServerClosed := make(chan bool)
 
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
 
 	lConfig := log.Config{}